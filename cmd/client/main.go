@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -11,9 +12,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/certs"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/client"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/tracing"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -48,17 +51,38 @@ func main() {
 func Main(pwd string, args []string, envs map[string]string, osSignal chan os.Signal) error {
 	var wg sync.WaitGroup
 
-	//get configuration
+	//get configuration and payload, the flags of both are registered before
+	// they're parsed
 	config := config.NewConfiguration()
-	config.FromCli(args)
-	config.FromEnvs(envs)
+	request := data.NewRequest()
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	config.Flags(flags)
+	request.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := config.FromEnvs(envs); err != nil {
+		return err
+	}
+
+	//create tracing, spans are written to stderr so they don't interleave
+	// with the responses
+	tracing, err := tracing.New(config, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tracing.Shutdown(context.Background())
+	}()
 
-	//create client
-	client := client.New(config)
+	//create client, requests are made over https if tls is configured
+	tlsConfig, err := certs.ClientConfig(config)
+	if err != nil {
+		return err
+	}
+	client := client.New(config, tracing, tlsConfig)
 
 	//generate payload
-	request := data.NewRequest()
-	request.FromArgs(args)
 	request.FromEnvs(envs)
 
 	//generate context
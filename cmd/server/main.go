@@ -1,19 +1,27 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	_ "time/tzdata"
 
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/certs"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/metrics"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/rls"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/server"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/tracing"
 
 	"github.com/pkg/errors"
 )
 
+const policyFlagShadow string = "shadow"
+
 func main() {
 	pwd, _ := os.Getwd()
 	args := os.Args[1:]
@@ -36,34 +44,159 @@ func main() {
 	}
 }
 
+// newLimiter creates the rate limiter for the given algorithm
+func newLimiter(algorithm string, parameters ...any) (limiter.Limiter, error) {
+	switch limiter.LimiterType(algorithm) {
+	default:
+		return nil, errors.Errorf("unsupported algorithm: %s", algorithm)
+	case limiter.LimiterTypeWeighted:
+		return limiter.NewWeighted(parameters...), nil
+	case limiter.LimiterTypeLeaky:
+		return limiter.NewLeaky(parameters...), nil
+	case limiter.LimiterTypeToken:
+		return limiter.NewToken(parameters...), nil
+	case limiter.LimiterTypeQuota:
+		return limiter.NewQuota(parameters...), nil
+	case limiter.LimiterTypeConcurrency:
+		return limiter.NewConcurrency(parameters...), nil
+	case limiter.LimiterTypeAdaptive:
+		return limiter.NewAdaptive(parameters...), nil
+	case limiter.LimiterTypeShedding:
+		return limiter.NewShedding(parameters...), nil
+	case limiter.LimiterTypeFair:
+		return limiter.NewFair(parameters...), nil
+	case limiter.LimiterTypeHierarchical:
+		return limiter.NewHierarchical(parameters...), nil
+	}
+}
+
+// newPolicies creates a rate limiter for each policy (e.g. "token_weighted"
+// or "leaky:shadow"), policies with the shadow flag are run in dry-run mode
+// and the policies are chained if there's more than one; the prefix (if any)
+// is prepended to the policy label (e.g. a route)
+func newPolicies(prefix string, policies []string, parameters ...any) (limiter.Limiter, error) {
+	var limiters []limiter.Limiter
+
+	for _, policy := range policies {
+		algorithm, flag, _ := strings.Cut(policy, ":")
+		rateLimiter, err := newLimiter(algorithm, append(parameters, limiter.Policy(prefix+policy))...)
+		if err != nil {
+			for _, l := range limiters {
+				l.Stop()
+			}
+			return nil, err
+		}
+		switch flag {
+		default:
+			rateLimiter.Stop()
+			for _, l := range limiters {
+				l.Stop()
+			}
+			return nil, errors.Errorf("unsupported policy flag: %s", flag)
+		case "":
+		case policyFlagShadow:
+			rateLimiter = limiter.NewShadow(append(parameters, rateLimiter, limiter.LimiterType(algorithm))...)
+		}
+		limiters = append(limiters, rateLimiter)
+	}
+	if len(limiters) == 1 {
+		return limiters[0], nil
+	}
+	return limiter.NewMulti(append(parameters, limiters)...), nil
+}
+
+// routeCapacity returns a copy of the configuration where the capacity of
+// every algorithm (tokens, queue size and quota) is the given capacity
+func routeCapacity(c *config.Configuration, capacity int64) *config.Configuration {
+	routeConfig := *c
+	routeConfig.Maxtokens = capacity
+	routeConfig.QueueSize = int(capacity)
+	routeConfig.QuotaLimit = capacity
+	return &routeConfig
+}
+
 func Main(pwd string, args []string, envs map[string]string, osSignal chan os.Signal) error {
 	var rateLimiter limiter.Limiter
+	var err error
 
 	//get configuration
 	config := config.NewConfiguration()
-	config.FromEnvs(envs)
+	if err := config.FromEnvs(envs); err != nil {
+		return err
+	}
+
+	//create logger, metrics and tracing
+	logger := logger.New(config)
+	registry := metrics.New(logger)
+	limiterMetrics := limiter.NewMetrics(config, registry)
+	tracing, err := tracing.New(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tracing.Shutdown(context.Background()); err != nil {
+			logger.Error("unable to shutdown tracing", "error", err)
+		}
+	}()
 
-	//create rate limiter if configured
-	switch limiter.LimiterType(config.Algorithm) {
+	//create rate limiter(s) if configured
+	switch {
+	case len(config.Policies) > 0:
+		if rateLimiter, err = newPolicies("", config.Policies, config, logger, limiterMetrics, tracing); err != nil {
+			return err
+		}
+		logger.Info("configured rate limiting policies", "policies", config.Policies)
 	default:
-		return errors.Errorf("unsupported algorithm: %s", config.Algorithm)
-	case limiter.LimiterTypeWeighted:
-		rateLimiter = limiter.NewWeighted(config)
-	case limiter.LimiterTypeLeaky:
-		rateLimiter = limiter.NewLeaky(config)
-	case limiter.LimiterTypeToken:
-		rateLimiter = limiter.NewToken(config)
+		if rateLimiter, err = newLimiter(config.Algorithm, config, logger, limiterMetrics, tracing); err != nil {
+			return err
+		}
+		logger.Info("configured rate limiting algorithm", "algorithm", config.Algorithm)
 	}
-	fmt.Printf("configured rate limiting algorithim: %s\n", config.Algorithm)
-	if rateLimiter != nil {
-		defer rateLimiter.Stop()
+	//create and start server, the allowlist and blocklist are evaluated
+	// before the rate limiter
+	access := limiter.NewAccess(config, logger)
+	tlsConfig, err := certs.ServerConfig(config)
+	if err != nil {
+		rateLimiter.Stop()
+		return err
 	}
-
-	//create and start server
-	server := server.New(config, rateLimiter)
+	//routes with a policy of their own (e.g. /compute) are limited by a
+	// limiter created for that route after the global rate limiter, its
+	// capacity is the route's limit (ROUTE_LIMITS) if it has one
+	limiterFactory := server.LimiterFactory(func(route, policy string) (limiter.Limiter, error) {
+		routeConfig := config
+		if capacity, ok := config.RouteLimits[route]; ok {
+			routeConfig = routeCapacity(config, capacity)
+		}
+		return newPolicies(route+" ", []string{policy}, routeConfig, logger, limiterMetrics, tracing)
+	})
+	server := server.New(config, rateLimiter, access, registry, logger, tracing, tlsConfig, limiterFactory)
 	if err := server.Start(); err != nil {
+		rateLimiter.Stop()
 		return err
 	}
+
+	//create and start the rate limit service (Envoy's RLS API) if configured,
+	// it shares the rate limiter with the server
+	var rlsServer rls.Server
+	if config.RlsPort != "" {
+		rlsServer = rls.New(config, rateLimiter, logger, tlsConfig)
+		if err := rlsServer.Start(); err != nil {
+			_ = server.Stop()
+			rateLimiter.Stop()
+			return err
+		}
+	}
 	<-osSignal
-	return server.Stop()
+
+	//drain the server(s) before stopping the rate limiter, in-flight requests
+	// are still waiting on (or releasing capacity to) the limiter
+	err = server.Stop()
+	if rlsServer != nil {
+		if err := rlsServer.Stop(); err != nil {
+			logger.Error("unable to stop rate limit service", "error", err)
+		}
+	}
+	rateLimiter.Stop()
+	return err
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+)
+
+// freePort returns a port that's free to listen on
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// start runs the server with the given environment until the test is done
+// and returns its address once it's listening
+func start(t *testing.T, envs map[string]string) string {
+	t.Helper()
+
+	port := freePort(t)
+	envs["HTTP_PORT"] = port
+	osSignal := make(chan os.Signal, 1)
+	chErr := make(chan error, 1)
+	go func() {
+		chErr <- Main("", nil, envs, osSignal)
+	}()
+	t.Cleanup(func() {
+		osSignal <- os.Interrupt
+		if err := <-chErr; err != nil {
+			t.Error(err)
+		}
+	})
+	address := "http://localhost:" + port
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if response, err := http.Get(address + data.RouteHealth); err == nil {
+			_ = response.Body.Close()
+			return address
+		}
+	}
+	t.Fatal("server didn't start")
+	return ""
+}
+
+func post(t *testing.T, address, route string) int {
+	t.Helper()
+
+	response, err := http.Post(address+route, "application/json",
+		strings.NewReader(`{"application_id":"application_id"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	return response.StatusCode
+}
+
+// TestRouteLimits verifies that a route's limit (ROUTE_LIMITS) replaces the
+// capacity of the route's limiter while the global limiter is still shared by
+// every route
+func TestRouteLimits(t *testing.T) {
+	address := start(t, map[string]string{
+		"ALGORITHM":         "token",
+		"MAX_TOKENS":        "12",
+		"TOKEN_REPLENISH_S": "60",
+		"ROUTE_LIMITS":      "/compute=6",
+	})
+
+	//compute costs 3, its limit of 6 is exhausted before the global capacity
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if statusCode := post(t, address, data.RouteCompute); statusCode != expected {
+			t.Fatalf("expected compute %d to be %d, got %d", i, expected, statusCode)
+		}
+	}
+	//ping's own limiter is full, but only 3 tokens are left globally (the
+	// global limiter is executed first, so the rejected compute took its cost)
+	for i := range 3 {
+		if statusCode := post(t, address, data.RoutePing); statusCode != http.StatusOK {
+			t.Fatalf("expected ping %d to be allowed, got %d", i, statusCode)
+		}
+	}
+	if statusCode := post(t, address, data.RoutePing); statusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected ping to be limited by the global limiter, got %d", statusCode)
+	}
+}
@@ -0,0 +1,110 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ClientAuthNone          string = ""
+	ClientAuthVerifyIfGiven string = "verify_if_given"
+	ClientAuthRequire       string = "require"
+)
+
+// certPool reads the PEM encoded certificate authorities from file
+func certPool(file string) (*x509.CertPool, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bytes) {
+		return nil, errors.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns the TLS configuration for a server from the
+// certificate and key, if client authentication is configured, client
+// certificates are verified against the certificate authority; if TLS isn't
+// configured (there's no certificate), it returns nil
+func ServerConfig(c *config.Configuration) (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSEnabled {
+			return nil, errors.New("tls is enabled, but no certificate and key are configured")
+		}
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch c.TLSClientAuth {
+	default:
+		return nil, errors.Errorf("unsupported client auth: %s", c.TLSClientAuth)
+	case ClientAuthNone:
+		return tlsConfig, nil
+	case ClientAuthVerifyIfGiven:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if c.TLSCAFile == "" {
+		return nil, errors.New("client auth requires a certificate authority")
+	}
+	if tlsConfig.ClientCAs, err = certPool(c.TLSCAFile); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// ClientConfig returns the TLS configuration for a client, the server is
+// verified against the certificate authority (or the system's if there
+// isn't one) and the certificate and key are presented as the client
+// certificate if configured; if TLS isn't enabled (or configured), it
+// returns nil
+func ClientConfig(c *config.Configuration) (*tls.Config, error) {
+	if !c.TLSEnabled && c.TLSCAFile == "" && c.TLSCertFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSCAFile != "" {
+		pool, err := certPool(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// Subject returns the subject of the (verified) client certificate of the
+// request, the common name is used if there is one, otherwise the entire
+// subject; if there's no client certificate, it returns an empty string
+func Subject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	certificate := r.TLS.VerifiedChains[0][0]
+	if certificate.Subject.CommonName != "" {
+		return certificate.Subject.CommonName
+	}
+	return certificate.Subject.String()
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -11,52 +12,85 @@ import (
 
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/tracing"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // const clientLogPrefix string = "[client] "
 
+const tracerName string = "github.com/antonio-alexander/go-blog-rate-limiting/internal/client"
+
 type client struct {
 	config struct {
 		timeout    time.Duration
 		retry      bool
 		maxRetries int
 	}
-	address string
+	address    string
+	tracer     trace.Tracer
+	httpClient *http.Client
 }
 
 type Client interface {
 	Wait(context.Context, *data.Request) (*data.Response, error)
 }
 
+// New creates a client, if a tls configuration is provided, requests are
+// made over https (presenting the client certificate if it has one)
 func New(parameters ...any) Client {
+	var tlsConfig *tls.Config
+	var host string
+
 	c := &client{}
 	for _, parameter := range parameters {
 		switch p := parameter.(type) {
 		case *config.Configuration:
-			c.address = "http://" + p.Host
+			host = p.Host
 			if p.Port != "" {
-				c.address += ":" + p.Port
+				host += ":" + p.Port
 			}
 			c.config.timeout = p.Timeout
 			c.config.retry = p.Retry
 			c.config.maxRetries = p.MaxRetries
+		case trace.TracerProvider:
+			c.tracer = p.Tracer(tracerName)
+		case *tls.Config:
+			tlsConfig = p
 		}
 	}
+	c.address, c.httpClient = "http://"+host, new(http.Client)
+	if tlsConfig != nil {
+		c.address = "https://" + host
+		c.httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	if c.tracer == nil {
+		c.tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
 	return c
 }
 
 func (c *client) doRequest(ctx context.Context, uri, method string, data []byte) ([]byte, int, error) {
-	client := new(http.Client)
+	ctx, span := c.tracer.Start(ctx, method+" "+uri, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	client := c.httpClient
 	ctx, cancel := context.WithTimeout(ctx, c.config.timeout)
 	defer cancel()
 	request, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, -1, err
 	}
+	tracing.Propagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
 	response, err := client.Do(request)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, -1, err
 	}
 	if c.config.retry && response.StatusCode == http.StatusTooManyRequests {
@@ -75,6 +109,7 @@ func (c *client) doRequest(ctx context.Context, uri, method string, data []byte)
 			if err != nil {
 				return nil, -1, err
 			}
+			span.AddEvent("retry", trace.WithAttributes(attribute.Int("retry", i+1)))
 			if response.StatusCode != http.StatusTooManyRequests {
 				break
 			}
@@ -85,6 +120,7 @@ func (c *client) doRequest(ctx context.Context, uri, method string, data []byte)
 		return nil, -1, err
 	}
 	response.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
 	return data, response.StatusCode, nil
 }
 
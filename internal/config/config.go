@@ -3,7 +3,10 @@ package config
 import (
 	"flag"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -18,27 +21,139 @@ const (
 	DefaultMaxRetries           int           = 2
 	DefaultMaxtokens            int64         = 4
 	DefaultTokenReplinsh        time.Duration = time.Second
+	DefaultCarryDebt            bool          = false
 	DefaultLeakRate             time.Duration = 250 * time.Millisecond
 	DefaultQueueSize            int           = 4
 	DefaultWeightMultiplier     int64         = 1
+	DefaultQuotaLimit           int64         = 50000
+	DefaultQuotaPeriod          string        = "monthly"
+	DefaultQuotaTimezone        string        = "UTC"
+	DefaultQuotaPersistInterval time.Duration = 10 * time.Second
+	DefaultMaxInFlight          int           = 2
+	DefaultMaxInFlightGlobal    int           = 8
+	DefaultInFlightQueueSize    int           = 0
+	DefaultInFlightQueueTimeout time.Duration = time.Second
+	DefaultAdaptiveInitialLimit int           = 4
+	DefaultAdaptiveMinLimit     int           = 1
+	DefaultAdaptiveMaxLimit     int           = 64
+	DefaultAdaptiveLatency      time.Duration = 2 * time.Second
+	DefaultAdaptiveBackoff      float64       = 0.9
+	DefaultSheddingMaxInFlight  int           = 8
+	DefaultSheddingBudgets      string        = "50,80,100"
+	DefaultFairQueueSize        int           = 8
+	DefaultFairQuantum          int64         = 1
+	DefaultFairBudget           int64         = 4
+	DefaultFairServiceRate      time.Duration = 250 * time.Millisecond
+	DefaultHierarchyBorrow      bool          = false
+	DefaultRefundStatusCodes    string        = "5xx"
+	DefaultCostMode             string        = "declared"
+	DefaultCostDurationUnit     time.Duration = 100 * time.Millisecond
+	DefaultCostBytesUnit        int64         = 1024
+	DefaultWeightMin            int64         = 1
+	DefaultWeightMax            int64         = 100
+	DefaultMetricsKeyLabels     int           = 0
+	DefaultLogFormat            string        = "text"
+	DefaultLogLevel             string        = "info"
+	DefaultLogSampleRate        int           = 1
+	DefaultTracingExporter      string        = ""
+	DefaultAdminPort            string        = ""
+	DefaultAdminToken           string        = ""
+	DefaultPenaltyRejections    int           = 0
+	DefaultPenaltyWindow        time.Duration = time.Minute
+	DefaultPenaltyDuration      time.Duration = 5 * time.Minute
+	DefaultDrainDelay           time.Duration = 0
+	DefaultDrainTimeout         time.Duration = 30 * time.Second
+	DefaultReadTimeout          time.Duration = 10 * time.Second
+	DefaultReadHeaderTimeout    time.Duration = 5 * time.Second
+	DefaultWriteTimeout         time.Duration = time.Minute
+	DefaultIdleTimeout          time.Duration = 2 * time.Minute
+	DefaultMaxBodyBytes         int64         = 1 << 20
+	DefaultTLSEnabled           bool          = false
+	DefaultTLSClientAuth        string        = ""
+	DefaultKeySource            string        = "application_id"
+	DefaultRlsPort              string        = ""
+	DefaultCheckPort            string        = ""
+	DefaultDecisionTimeout      time.Duration = 500 * time.Millisecond
 )
 
 const (
-	HTTP_ADDRESS           string = "HTTP_ADDRESS"
-	HTTP_PORT              string = "HTTP_PORT"
-	TIMEOUT                string = "TIMEOUT"
-	MODE                   string = "MODE"
-	NUMBER_OF_REQUESTS     string = "NUMBER_OF_REQUESTS"
-	NUMBER_OF_APPLICATIONS string = "NUMBER_OF_APPLICATIONS"
-	REQUEST_RATE           string = "REQUEST_RATE"
-	RETRY                  string = "RETRY"
-	MAX_RETRIES            string = "MAX_RETRIES"
-	ALGORITHM              string = "ALGORITHM"
-	MAX_TOKENS             string = "MAX_TOKENS"
-	TOKEN_REPLENISH        string = "TOKEN_REPLENISH_S"
-	QUEUE_SIZE             string = "QUEUE_SIZE"
-	LEAK_RATE              string = "LEAK_RATE_S"
-	WEIGHT_MULTIPLIER      string = "WEIGHT_MULTIPLIER"
+	HTTP_ADDRESS            string = "HTTP_ADDRESS"
+	HTTP_PORT               string = "HTTP_PORT"
+	TIMEOUT                 string = "TIMEOUT"
+	MODE                    string = "MODE"
+	NUMBER_OF_REQUESTS      string = "NUMBER_OF_REQUESTS"
+	NUMBER_OF_APPLICATIONS  string = "NUMBER_OF_APPLICATIONS"
+	REQUEST_RATE            string = "REQUEST_RATE"
+	RETRY                   string = "RETRY"
+	MAX_RETRIES             string = "MAX_RETRIES"
+	ALGORITHM               string = "ALGORITHM"
+	MAX_TOKENS              string = "MAX_TOKENS"
+	TOKEN_REPLENISH         string = "TOKEN_REPLENISH_S"
+	CARRY_DEBT              string = "CARRY_DEBT"
+	QUEUE_SIZE              string = "QUEUE_SIZE"
+	LEAK_RATE               string = "LEAK_RATE_S"
+	WEIGHT_MULTIPLIER       string = "WEIGHT_MULTIPLIER"
+	QUOTA_LIMIT             string = "QUOTA_LIMIT"
+	QUOTA_PERIOD            string = "QUOTA_PERIOD"
+	QUOTA_TIMEZONE          string = "QUOTA_TIMEZONE"
+	QUOTA_FILE              string = "QUOTA_FILE"
+	QUOTA_PERSIST_INTERVAL  string = "QUOTA_PERSIST_INTERVAL_S"
+	MAX_IN_FLIGHT           string = "MAX_IN_FLIGHT"
+	MAX_IN_FLIGHT_GLOBAL    string = "MAX_IN_FLIGHT_GLOBAL"
+	IN_FLIGHT_QUEUE_SIZE    string = "IN_FLIGHT_QUEUE_SIZE"
+	IN_FLIGHT_QUEUE_TIMEOUT string = "IN_FLIGHT_QUEUE_TIMEOUT_MS"
+	ADAPTIVE_INITIAL_LIMIT  string = "ADAPTIVE_INITIAL_LIMIT"
+	ADAPTIVE_MIN_LIMIT      string = "ADAPTIVE_MIN_LIMIT"
+	ADAPTIVE_MAX_LIMIT      string = "ADAPTIVE_MAX_LIMIT"
+	ADAPTIVE_LATENCY        string = "ADAPTIVE_LATENCY_MS"
+	ADAPTIVE_BACKOFF        string = "ADAPTIVE_BACKOFF"
+	SHEDDING_MAX_IN_FLIGHT  string = "SHEDDING_MAX_IN_FLIGHT"
+	SHEDDING_BUDGETS        string = "SHEDDING_BUDGETS"
+	FAIR_QUEUE_SIZE         string = "FAIR_QUEUE_SIZE"
+	FAIR_QUANTUM            string = "FAIR_QUANTUM"
+	FAIR_BUDGET             string = "FAIR_BUDGET"
+	FAIR_SERVICE_RATE       string = "FAIR_SERVICE_RATE_MS"
+	HIERARCHY               string = "HIERARCHY"
+	HIERARCHY_LIMITS        string = "HIERARCHY_LIMITS"
+	HIERARCHY_BORROW        string = "HIERARCHY_BORROW"
+	REFUND_STATUS_CODES     string = "REFUND_STATUS_CODES"
+	COST_MODE               string = "COST_MODE"
+	COST_DURATION_UNIT      string = "COST_DURATION_UNIT_MS"
+	COST_BYTES_UNIT         string = "COST_BYTES_UNIT"
+	COST_TABLE              string = "COST_TABLE"
+	WEIGHT_MIN              string = "WEIGHT_MIN"
+	WEIGHT_MAX              string = "WEIGHT_MAX"
+	POLICIES                string = "POLICIES"
+	METRICS_KEY_LABELS      string = "METRICS_KEY_LABELS"
+	LOG_FORMAT              string = "LOG_FORMAT"
+	LOG_LEVEL               string = "LOG_LEVEL"
+	LOG_SAMPLE_RATE         string = "LOG_SAMPLE_RATE"
+	TRACING_EXPORTER        string = "TRACING_EXPORTER"
+	ADMIN_PORT              string = "ADMIN_PORT"
+	ADMIN_TOKEN             string = "ADMIN_TOKEN"
+	ALLOWLIST               string = "ALLOWLIST"
+	BLOCKLIST               string = "BLOCKLIST"
+	PENALTY_REJECTIONS      string = "PENALTY_REJECTIONS"
+	PENALTY_WINDOW          string = "PENALTY_WINDOW_S"
+	PENALTY_DURATION        string = "PENALTY_DURATION_S"
+	DRAIN_DELAY             string = "DRAIN_DELAY_S"
+	DRAIN_TIMEOUT           string = "DRAIN_TIMEOUT_S"
+	READ_TIMEOUT            string = "READ_TIMEOUT"
+	READ_HEADER_TIMEOUT     string = "READ_HEADER_TIMEOUT"
+	WRITE_TIMEOUT           string = "WRITE_TIMEOUT"
+	IDLE_TIMEOUT            string = "IDLE_TIMEOUT"
+	MAX_BODY_BYTES          string = "MAX_BODY_BYTES"
+	TLS_ENABLED             string = "TLS_ENABLED"
+	TLS_CERT_FILE           string = "TLS_CERT_FILE"
+	TLS_KEY_FILE            string = "TLS_KEY_FILE"
+	TLS_CA_FILE             string = "TLS_CA_FILE"
+	TLS_CLIENT_AUTH         string = "TLS_CLIENT_AUTH"
+	KEY_SOURCE              string = "KEY_SOURCE"
+	RLS_PORT                string = "RLS_PORT"
+	ROUTE_POLICIES          string = "ROUTE_POLICIES"
+	ROUTE_LIMITS            string = "ROUTE_LIMITS"
+	CHECK_PORT              string = "CHECK_PORT"
+	DECISION_TIMEOUT        string = "DECISION_TIMEOUT_MS"
 )
 
 type Configuration struct {
@@ -53,10 +168,131 @@ type Configuration struct {
 	MaxRetries           int
 	Maxtokens            int64
 	TokenReplinish       time.Duration
+	CarryDebt            bool
 	Algorithm            string
 	QueueSize            int
 	LeakRate             time.Duration
 	WeightMultiplier     int64
+	QuotaLimit           int64
+	QuotaPeriod          string
+	QuotaTimezone        string
+	QuotaFile            string
+	QuotaPersistInterval time.Duration
+	MaxInFlight          int
+	MaxInFlightGlobal    int
+	InFlightQueueSize    int
+	InFlightQueueTimeout time.Duration
+	AdaptiveInitialLimit int
+	AdaptiveMinLimit     int
+	AdaptiveMaxLimit     int
+	AdaptiveLatency      time.Duration
+	AdaptiveBackoff      float64
+	SheddingMaxInFlight  int
+	SheddingBudgets      []int
+	FairQueueSize        int
+	FairQuantum          int64
+	FairBudget           int64
+	FairServiceRate      time.Duration
+	Hierarchy            map[string]string
+	HierarchyLimits      map[string]int64
+	HierarchyBorrow      bool
+	RefundStatusCodes    []string
+	CostMode             string
+	CostDurationUnit     time.Duration
+	CostBytesUnit        int64
+	CostTable            map[string]int64
+	WeightMin            int64
+	WeightMax            int64
+	Policies             []string
+	MetricsKeyLabels     int
+	LogFormat            string
+	LogLevel             string
+	LogSampleRate        int
+	TracingExporter      string
+	AdminPort            string
+	AdminToken           string
+	Allowlist            map[string]time.Duration
+	Blocklist            map[string]time.Duration
+	PenaltyRejections    int
+	PenaltyWindow        time.Duration
+	PenaltyDuration      time.Duration
+	DrainDelay           time.Duration
+	DrainTimeout         time.Duration
+	ReadTimeout          time.Duration
+	ReadHeaderTimeout    time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxBodyBytes         int64
+	TLSEnabled           bool
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSCAFile            string
+	TLSClientAuth        string
+	KeySource            string
+	RlsPort              string
+	RoutePolicies        map[string]string
+	RouteLimits          map[string]int64
+	CheckPort            string
+	DecisionTimeout      time.Duration
+}
+
+// parseInts parses a comma separated list of integers, values that can't be
+// parsed are ignored
+func parseInts(s string) []int {
+	var ints []int
+
+	for _, s := range strings.Split(s, ",") {
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			continue
+		}
+		ints = append(ints, int(i))
+	}
+	return ints
+}
+
+// parseStrings parses a comma separated list of strings, empty values are
+// ignored
+func parseStrings(s string) []string {
+	var strs []string
+
+	for _, s := range strings.Split(s, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// parsePairs parses a comma separated list of key=value pairs (e.g.
+// "app1=org1,app2=org1"), pairs without a key or value are ignored
+func parsePairs(s string) map[string]string {
+	pairs := make(map[string]string)
+	for _, s := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(s, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			continue
+		}
+		pairs[key] = value
+	}
+	return pairs
+}
+
+// parseExpiring parses a comma separated list of keys that optionally expire
+// after a number of seconds (e.g. "app1,app2=3600"), keys without an
+// expiration map to zero (they never expire)
+func parseExpiring(s string) map[string]time.Duration {
+	expiring := make(map[string]time.Duration)
+	for _, s := range parseStrings(s) {
+		key, value, _ := strings.Cut(s, "=")
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		i, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		expiring[key] = time.Duration(max(i, 0)) * time.Second
+	}
+	return expiring
 }
 
 func NewConfiguration() *Configuration {
@@ -72,13 +308,73 @@ func NewConfiguration() *Configuration {
 		MaxRetries:           DefaultMaxRetries,
 		Maxtokens:            DefaultMaxtokens,
 		TokenReplinish:       DefaultTokenReplinsh,
+		CarryDebt:            DefaultCarryDebt,
 		QueueSize:            DefaultQueueSize,
 		LeakRate:             DefaultLeakRate,
 		WeightMultiplier:     DefaultWeightMultiplier,
+		QuotaLimit:           DefaultQuotaLimit,
+		QuotaPeriod:          DefaultQuotaPeriod,
+		QuotaTimezone:        DefaultQuotaTimezone,
+		QuotaPersistInterval: DefaultQuotaPersistInterval,
+		MaxInFlight:          DefaultMaxInFlight,
+		MaxInFlightGlobal:    DefaultMaxInFlightGlobal,
+		InFlightQueueSize:    DefaultInFlightQueueSize,
+		InFlightQueueTimeout: DefaultInFlightQueueTimeout,
+		AdaptiveInitialLimit: DefaultAdaptiveInitialLimit,
+		AdaptiveMinLimit:     DefaultAdaptiveMinLimit,
+		AdaptiveMaxLimit:     DefaultAdaptiveMaxLimit,
+		AdaptiveLatency:      DefaultAdaptiveLatency,
+		AdaptiveBackoff:      DefaultAdaptiveBackoff,
+		SheddingMaxInFlight:  DefaultSheddingMaxInFlight,
+		SheddingBudgets:      parseInts(DefaultSheddingBudgets),
+		FairQueueSize:        DefaultFairQueueSize,
+		FairQuantum:          DefaultFairQuantum,
+		FairBudget:           DefaultFairBudget,
+		FairServiceRate:      DefaultFairServiceRate,
+		Hierarchy:            make(map[string]string),
+		HierarchyLimits:      make(map[string]int64),
+		HierarchyBorrow:      DefaultHierarchyBorrow,
+		RefundStatusCodes:    parseStrings(DefaultRefundStatusCodes),
+		CostMode:             DefaultCostMode,
+		CostDurationUnit:     DefaultCostDurationUnit,
+		CostBytesUnit:        DefaultCostBytesUnit,
+		CostTable:            make(map[string]int64),
+		WeightMin:            DefaultWeightMin,
+		WeightMax:            DefaultWeightMax,
+		MetricsKeyLabels:     DefaultMetricsKeyLabels,
+		LogFormat:            DefaultLogFormat,
+		LogLevel:             DefaultLogLevel,
+		LogSampleRate:        DefaultLogSampleRate,
+		TracingExporter:      DefaultTracingExporter,
+		AdminPort:            DefaultAdminPort,
+		AdminToken:           DefaultAdminToken,
+		Allowlist:            make(map[string]time.Duration),
+		Blocklist:            make(map[string]time.Duration),
+		PenaltyRejections:    DefaultPenaltyRejections,
+		PenaltyWindow:        DefaultPenaltyWindow,
+		PenaltyDuration:      DefaultPenaltyDuration,
+		DrainDelay:           DefaultDrainDelay,
+		DrainTimeout:         DefaultDrainTimeout,
+		ReadTimeout:          DefaultReadTimeout,
+		ReadHeaderTimeout:    DefaultReadHeaderTimeout,
+		WriteTimeout:         DefaultWriteTimeout,
+		IdleTimeout:          DefaultIdleTimeout,
+		MaxBodyBytes:         DefaultMaxBodyBytes,
+		TLSEnabled:           DefaultTLSEnabled,
+		TLSClientAuth:        DefaultTLSClientAuth,
+		KeySource:            DefaultKeySource,
+		RlsPort:              DefaultRlsPort,
+		CheckPort:            DefaultCheckPort,
+		DecisionTimeout:      DefaultDecisionTimeout,
+		RoutePolicies:        make(map[string]string),
+		RouteLimits:          make(map[string]int64),
 	}
 }
 
-func (c *Configuration) FromEnvs(envs map[string]string) {
+// FromEnvs reads the configuration from the environment, it returns an
+// error for values that can't be used (e.g. a hierarchy limit that isn't a
+// positive number)
+func (c *Configuration) FromEnvs(envs map[string]string) error {
 	if s := envs[HTTP_PORT]; s != "" {
 		c.Port = s
 	}
@@ -125,6 +421,9 @@ func (c *Configuration) FromEnvs(envs map[string]string) {
 		i, _ := strconv.ParseInt(s, 10, 64)
 		c.TokenReplinish = time.Duration(i) * time.Minute
 	}
+	if s := envs[CARRY_DEBT]; s != "" {
+		c.CarryDebt, _ = strconv.ParseBool(s)
+	}
 	if s := envs[LEAK_RATE]; s != "" {
 		i, _ := strconv.ParseInt(s, 10, 64)
 		c.LeakRate = time.Duration(i) * time.Millisecond
@@ -132,24 +431,266 @@ func (c *Configuration) FromEnvs(envs map[string]string) {
 	if s := envs[WEIGHT_MULTIPLIER]; s != "" {
 		c.WeightMultiplier, _ = strconv.ParseInt(s, 10, 64)
 	}
+	if s := envs[QUOTA_LIMIT]; s != "" {
+		c.QuotaLimit, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[QUOTA_PERIOD]; s != "" {
+		switch s {
+		default:
+			return errors.Errorf("invalid %s: %q", QUOTA_PERIOD, s)
+		case "daily", "monthly":
+		}
+		c.QuotaPeriod = s
+	}
+	if s := envs[QUOTA_TIMEZONE]; s != "" {
+		c.QuotaTimezone = s
+	}
+	if s := envs[QUOTA_FILE]; s != "" {
+		c.QuotaFile = s
+	}
+	if s := envs[QUOTA_PERSIST_INTERVAL]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.QuotaPersistInterval = time.Duration(i) * time.Second
+	}
+	if s := envs[MAX_IN_FLIGHT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.MaxInFlight = int(i)
+	}
+	if s := envs[MAX_IN_FLIGHT_GLOBAL]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.MaxInFlightGlobal = int(i)
+	}
+	if s := envs[IN_FLIGHT_QUEUE_SIZE]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.InFlightQueueSize = int(i)
+	}
+	if s := envs[IN_FLIGHT_QUEUE_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.InFlightQueueTimeout = time.Duration(i) * time.Millisecond
+	}
+	if s := envs[ADAPTIVE_INITIAL_LIMIT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.AdaptiveInitialLimit = int(i)
+	}
+	if s := envs[ADAPTIVE_MIN_LIMIT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.AdaptiveMinLimit = int(i)
+	}
+	if s := envs[ADAPTIVE_MAX_LIMIT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.AdaptiveMaxLimit = int(i)
+	}
+	if s := envs[ADAPTIVE_LATENCY]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.AdaptiveLatency = time.Duration(i) * time.Millisecond
+	}
+	if s := envs[ADAPTIVE_BACKOFF]; s != "" {
+		c.AdaptiveBackoff, _ = strconv.ParseFloat(s, 64)
+	}
+	if s := envs[SHEDDING_MAX_IN_FLIGHT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.SheddingMaxInFlight = int(i)
+	}
+	if s := envs[SHEDDING_BUDGETS]; s != "" {
+		c.SheddingBudgets = parseInts(s)
+	}
+	if s := envs[FAIR_QUEUE_SIZE]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.FairQueueSize = int(i)
+	}
+	if s := envs[FAIR_QUANTUM]; s != "" {
+		c.FairQuantum, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[FAIR_BUDGET]; s != "" {
+		c.FairBudget, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[FAIR_SERVICE_RATE]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.FairServiceRate = time.Duration(i) * time.Millisecond
+	}
+	if s := envs[HIERARCHY]; s != "" {
+		c.Hierarchy = parsePairs(s)
+	}
+	if s := envs[HIERARCHY_LIMITS]; s != "" {
+		for key, value := range parsePairs(s) {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || i <= 0 {
+				return errors.Errorf("invalid %s for %s: %q", HIERARCHY_LIMITS, key, value)
+			}
+			c.HierarchyLimits[key] = i
+		}
+	}
+	if s := envs[HIERARCHY_BORROW]; s != "" {
+		c.HierarchyBorrow, _ = strconv.ParseBool(s)
+	}
+	if s, ok := envs[REFUND_STATUS_CODES]; ok {
+		//an empty value disables automatic refunds
+		c.RefundStatusCodes = parseStrings(s)
+	}
+	if s := envs[COST_MODE]; s != "" {
+		c.CostMode = s
+	}
+	if s := envs[COST_DURATION_UNIT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.CostDurationUnit = time.Duration(i) * time.Millisecond
+	}
+	if s := envs[COST_BYTES_UNIT]; s != "" {
+		c.CostBytesUnit, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[COST_TABLE]; s != "" {
+		for key, value := range parsePairs(s) {
+			c.CostTable[key], _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if s := envs[WEIGHT_MIN]; s != "" {
+		c.WeightMin, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[WEIGHT_MAX]; s != "" {
+		c.WeightMax, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[POLICIES]; s != "" {
+		c.Policies = parseStrings(s)
+	}
+	if s := envs[METRICS_KEY_LABELS]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.MetricsKeyLabels = int(i)
+	}
+	if s := envs[LOG_FORMAT]; s != "" {
+		c.LogFormat = s
+	}
+	if s := envs[LOG_LEVEL]; s != "" {
+		c.LogLevel = s
+	}
+	if s := envs[LOG_SAMPLE_RATE]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.LogSampleRate = int(i)
+	}
+	if s := envs[TRACING_EXPORTER]; s != "" {
+		c.TracingExporter = s
+	}
+	if s := envs[ADMIN_PORT]; s != "" {
+		c.AdminPort = s
+	}
+	if s := envs[ADMIN_TOKEN]; s != "" {
+		c.AdminToken = s
+	}
+	if s := envs[ALLOWLIST]; s != "" {
+		c.Allowlist = parseExpiring(s)
+	}
+	if s := envs[BLOCKLIST]; s != "" {
+		c.Blocklist = parseExpiring(s)
+	}
+	if s := envs[PENALTY_REJECTIONS]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.PenaltyRejections = int(i)
+	}
+	if s := envs[PENALTY_WINDOW]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.PenaltyWindow = time.Duration(i) * time.Second
+	}
+	if s := envs[PENALTY_DURATION]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.PenaltyDuration = time.Duration(i) * time.Second
+	}
+	if s := envs[DRAIN_DELAY]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.DrainDelay = time.Duration(i) * time.Second
+	}
+	if s := envs[DRAIN_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.DrainTimeout = time.Duration(i) * time.Second
+	}
+	if s := envs[READ_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.ReadTimeout = time.Duration(i) * time.Second
+	}
+	if s := envs[READ_HEADER_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.ReadHeaderTimeout = time.Duration(i) * time.Second
+	}
+	if s := envs[WRITE_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.WriteTimeout = time.Duration(i) * time.Second
+	}
+	if s := envs[IDLE_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.IdleTimeout = time.Duration(i) * time.Second
+	}
+	if s := envs[MAX_BODY_BYTES]; s != "" {
+		c.MaxBodyBytes, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s := envs[TLS_ENABLED]; s != "" {
+		c.TLSEnabled, _ = strconv.ParseBool(s)
+	}
+	if s := envs[TLS_CERT_FILE]; s != "" {
+		c.TLSCertFile = s
+	}
+	if s := envs[TLS_KEY_FILE]; s != "" {
+		c.TLSKeyFile = s
+	}
+	if s := envs[TLS_CA_FILE]; s != "" {
+		c.TLSCAFile = s
+	}
+	if s := envs[TLS_CLIENT_AUTH]; s != "" {
+		c.TLSClientAuth = s
+	}
+	if s := envs[KEY_SOURCE]; s != "" {
+		c.KeySource = s
+	}
+	if s := envs[RLS_PORT]; s != "" {
+		c.RlsPort = s
+	}
+	if s := envs[ROUTE_POLICIES]; s != "" {
+		for route, policy := range parsePairs(s) {
+			c.RoutePolicies[route] = policy
+		}
+	}
+	if s := envs[ROUTE_LIMITS]; s != "" {
+		for route, value := range parsePairs(s) {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || i <= 0 {
+				return errors.Errorf("invalid %s for %s: %q", ROUTE_LIMITS, route, value)
+			}
+			c.RouteLimits[route] = i
+		}
+	}
+	if s := envs[CHECK_PORT]; s != "" {
+		c.CheckPort = s
+	}
+	if s := envs[DECISION_TIMEOUT]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		c.DecisionTimeout = time.Duration(i) * time.Millisecond
+	}
+	return nil
 }
 
-func (c *Configuration) FromCli(args []string) {
-	var timeout, requestRate int
+// seconds returns a flag.Func that parses a number of seconds into d
+func seconds(d *time.Duration) func(string) error {
+	return func(s string) error {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*d = time.Second * time.Duration(i)
+		return nil
+	}
+}
 
-	if len(args) <= 0 {
-		return
-	}
-	flag.StringVar(&c.Host, "address", DefaultHost, "")
-	flag.StringVar(&c.Port, "port", DefaultHttpPort, "")
-	flag.StringVar(&c.Mode, "mode", DefaultMode, "")
-	flag.IntVar(&c.NumberOfApplications, "number-of-applications", DefaultNumberOfApplications, "")
-	flag.IntVar(&c.NumberOfRequests, "number-of-requests", DefaultNumberOfRequests, "")
-	flag.IntVar(&timeout, "timeout", int(DefaultTimeout/time.Second), "")
-	flag.IntVar(&requestRate, "request-rate", int(DefaultRequestRate/time.Second), "")
-	flag.BoolVar(&c.Retry, "retry", DefaultRetry, "")
-	flag.IntVar(&c.MaxRetries, "max-retries", DefaultMaxRetries, "")
-	flag.Parse()
-	c.Timeout = time.Second * time.Duration(timeout)
-	c.RequestRate = time.Second * time.Duration(requestRate)
+// Flags registers the client's flags on the flag set, the values are set
+// once the flag set is parsed; every flag (e.g. the request's) has to be
+// registered before it's parsed
+func (c *Configuration) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Host, "address", DefaultHost, "")
+	fs.StringVar(&c.Port, "port", DefaultHttpPort, "")
+	fs.StringVar(&c.Mode, "mode", DefaultMode, "")
+	fs.IntVar(&c.NumberOfApplications, "number-of-applications", DefaultNumberOfApplications, "")
+	fs.IntVar(&c.NumberOfRequests, "number-of-requests", DefaultNumberOfRequests, "")
+	fs.Func("timeout", "", seconds(&c.Timeout))
+	fs.Func("request-rate", "", seconds(&c.RequestRate))
+	fs.BoolVar(&c.Retry, "retry", DefaultRetry, "")
+	fs.IntVar(&c.MaxRetries, "max-retries", DefaultMaxRetries, "")
+	fs.BoolVar(&c.TLSEnabled, "tls", DefaultTLSEnabled, "")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", "", "")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", "", "")
+	fs.StringVar(&c.TLSCAFile, "tls-ca", "", "")
 }
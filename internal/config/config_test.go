@@ -0,0 +1,36 @@
+package config
+
+import "testing"
+
+// TestHierarchyLimitsInvalid verifies that hierarchy limits that aren't
+// positive numbers are an error rather than buckets without capacity
+func TestHierarchyLimitsInvalid(t *testing.T) {
+	for _, value := range []string{"org=ten", "org=0", "org=-1"} {
+		c := NewConfiguration()
+		if err := c.FromEnvs(map[string]string{HIERARCHY_LIMITS: value}); err == nil {
+			t.Errorf("expected an error for %s", value)
+		}
+	}
+	c := NewConfiguration()
+	if err := c.FromEnvs(map[string]string{HIERARCHY_LIMITS: "org=10,app=2"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.HierarchyLimits["org"] != 10 || c.HierarchyLimits["app"] != 2 {
+		t.Fatalf("unexpected hierarchy limits: %v", c.HierarchyLimits)
+	}
+}
+
+// TestQuotaPeriodInvalid verifies that a quota period other than daily or
+// monthly is an error rather than silently treated as monthly
+func TestQuotaPeriodInvalid(t *testing.T) {
+	c := NewConfiguration()
+	if err := c.FromEnvs(map[string]string{QUOTA_PERIOD: "weekly"}); err == nil {
+		t.Fatal("expected an error for weekly")
+	}
+	for _, value := range []string{"daily", "monthly"} {
+		c := NewConfiguration()
+		if err := c.FromEnvs(map[string]string{QUOTA_PERIOD: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package data
+
+import "time"
+
+// KeyState is the state of a single key (e.g. an application) in a rate
+// limiter, tokens is the remaining capacity (e.g. tokens in a bucket or free
+// slots in a queue) and fill is how full the bucket is (from 0 to 1)
+type KeyState struct {
+	Key         string    `json:"key"`
+	Tokens      int64     `json:"tokens,string"`
+	Fill        float64   `json:"fill"`
+	QueueLength int       `json:"queue_length,string"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type Keys struct {
+	Keys []string `json:"keys"`
+}
+
+// Grant is temporary extra capacity for a key, the capacity is increased by
+// the given number of tokens until the duration elapses
+type Grant struct {
+	Tokens   int64         `json:"tokens,string"`
+	Duration time.Duration `json:"duration,string"`
+}
+
+// AccessEntry is a key in the allowlist or blocklist, the reason is where
+// the entry came from (config, admin or penalty); if expires is nil, the
+// entry never expires
+type AccessEntry struct {
+	Key     string     `json:"key"`
+	Reason  string     `json:"reason"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Access is the allowlist and blocklist, allowed keys bypass rate limiting
+// and blocked keys are rejected
+type Access struct {
+	Allowed []AccessEntry `json:"allowed"`
+	Blocked []AccessEntry `json:"blocked"`
+}
+
+// Expiry is how long an allowlist or blocklist entry lasts, zero means it
+// never expires
+type Expiry struct {
+	Duration time.Duration `json:"duration,string"`
+}
@@ -0,0 +1,17 @@
+package data
+
+// Check is a decision-only request (e.g. from a gateway), the key and cost
+// can also be provided as headers (e.g. nginx auth_request doesn't forward
+// the body)
+type Check struct {
+	Key  string `json:"key"`
+	Cost int64  `json:"cost,string"`
+}
+
+// Decision is whether a check was allowed, the remaining capacity of the
+// key is included if the limiter can tell
+type Decision struct {
+	Key       string `json:"key"`
+	Allowed   bool   `json:"allowed"`
+	Remaining *int64 `json:"remaining,string,omitempty"`
+}
@@ -3,6 +3,59 @@ package data
 import "net/http"
 
 const (
-	MethodWait        = http.MethodPost
-	RouteWait  string = "/wait"
+	MethodWait           = http.MethodPost
+	RouteWait     string = "/wait"
+	MethodQuota          = http.MethodGet
+	RouteQuota    string = "/quota/{application_id}"
+	MethodMetrics        = http.MethodGet
+	RouteMetrics  string = "/metrics"
+	MethodHealth         = http.MethodGet
+	RouteHealth   string = "/healthz"
+	MethodReady          = http.MethodGet
+	RouteReady    string = "/readyz"
+	MethodCheck          = http.MethodPost
+	RouteCheck    string = "/v1/check"
+	MethodPing           = http.MethodPost
+	RoutePing     string = "/ping"
+	MethodCompute        = http.MethodPost
+	RouteCompute  string = "/compute"
+	MethodUpload         = http.MethodPost
+	RouteUpload   string = "/upload"
+)
+
+const (
+	MethodAdminKeys            = http.MethodGet
+	RouteAdminKeys      string = "/admin/keys"
+	MethodAdminKey             = http.MethodGet
+	RouteAdminKey       string = "/admin/keys/{key}"
+	MethodAdminKeyReset        = http.MethodPost
+	RouteAdminKeyReset  string = "/admin/keys/{key}/reset"
+	MethodAdminKeyGrant        = http.MethodPost
+	RouteAdminKeyGrant  string = "/admin/keys/{key}/grant"
+	MethodAdminAccess          = http.MethodGet
+	RouteAdminAccess    string = "/admin/access"
+	MethodAdminAllow           = http.MethodPost
+	RouteAdminAllow     string = "/admin/access/allow/{key}"
+	MethodAdminBlock           = http.MethodPost
+	RouteAdminBlock     string = "/admin/access/block/{key}"
+	MethodAdminRemove          = http.MethodDelete
+	RouteAdminRemove    string = "/admin/access/{key}"
+
+	//QueryAdminRoute selects the limiter of a route (e.g. ?route=/ping) for
+	// the admin key endpoints
+	QueryAdminRoute string = "route"
+)
+
+const (
+	HeaderQuotaLimit     string = "X-Quota-Limit"
+	HeaderQuotaRemaining string = "X-Quota-Remaining"
+	HeaderQuotaReset     string = "X-Quota-Reset"
+	HeaderQuotaWarning   string = "X-Quota-Warning"
+)
+
+const (
+	HeaderRateLimitRemaining  string = "X-RateLimit-Remaining"
+	HeaderRateLimitKey        string = "X-RateLimit-Key"
+	HeaderRateLimitCost       string = "X-RateLimit-Cost"
+	HeaderRateLimitDenyStatus string = "X-RateLimit-Deny-Status"
 )
@@ -0,0 +1,12 @@
+package data
+
+import "time"
+
+type Quota struct {
+	ApplicationId string    `json:"application_id"`
+	Period        string    `json:"period"`
+	Limit         int64     `json:"limit,string"`
+	Used          int64     `json:"used,string"`
+	Remaining     int64     `json:"remaining,string"`
+	Reset         time.Time `json:"reset"`
+}
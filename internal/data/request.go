@@ -13,8 +13,19 @@ import (
 )
 
 const (
-	defaultWait   time.Duration = 5 * time.Second
-	defaultWeight int64         = 1
+	defaultWait     time.Duration = 5 * time.Second
+	defaultWeight   int64         = 1
+	defaultPriority Priority      = PriorityNormal
+)
+
+// Priority is the class of a request, when the server is saturated lower
+// priority requests are shed before higher priority requests
+type Priority int64
+
+const (
+	PriorityLow    Priority = 0
+	PriorityNormal Priority = 1
+	PriorityHigh   Priority = 2
 )
 
 type Request struct {
@@ -22,24 +33,39 @@ type Request struct {
 	ApplicationId string        `json:"application_id"`
 	Wait          time.Duration `json:"wait,string"`
 	Weight        int64         `json:"weight,string"`
+	Priority      Priority      `json:"priority,string"`
 }
 
 func NewRequest() *Request {
 	return &Request{
-		Wait:   defaultWait,
-		Weight: defaultWeight,
+		Wait:     defaultWait,
+		Weight:   defaultWeight,
+		Priority: defaultPriority,
 	}
 }
 
-func (r *Request) FromArgs(args []string) {
-	var wait int
-
-	flag.StringVar(&r.Id, "id", uuid.Must(uuid.NewRandom()).String(), "")
-	flag.StringVar(&r.ApplicationId, "application_id", uuid.Must(uuid.NewRandom()).String(), "")
-	flag.IntVar(&wait, "wait", int(defaultWait/time.Second), "")
-	flag.Int64Var(&r.Weight, "weight", defaultWeight, "")
-	flag.Parse()
-	r.Wait = time.Second * time.Duration(wait)
+// Flags registers the request's flags on the flag set, the values are set
+// once the flag set is parsed
+func (r *Request) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&r.Id, "id", uuid.Must(uuid.NewRandom()).String(), "")
+	fs.StringVar(&r.ApplicationId, "application_id", uuid.Must(uuid.NewRandom()).String(), "")
+	fs.Func("wait", "", func(s string) error {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		r.Wait = time.Second * time.Duration(i)
+		return nil
+	})
+	fs.Int64Var(&r.Weight, "weight", defaultWeight, "")
+	fs.Func("priority", "", func(s string) error {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		r.Priority = Priority(i)
+		return nil
+	})
 }
 
 func (r *Request) FromEnvs(envs map[string]string) {
@@ -52,6 +78,10 @@ func (r *Request) FromEnvs(envs map[string]string) {
 	if s := envs["WEIGHT"]; s != "" {
 		r.Weight, _ = strconv.ParseInt(s, 10, 64)
 	}
+	if s := envs["PRIORITY"]; s != "" {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		r.Priority = Priority(i)
+	}
 	if s := envs["WAIT"]; s != "" {
 		i, _ := strconv.Atoi(s)
 		r.Wait = time.Duration(i) * time.Second
@@ -7,4 +7,6 @@ type Response struct {
 	ApplicationId string        `json:"application_id"`
 	Wait          time.Duration `json:"wait,string"`
 	Weight        int64         `json:"weight,string"`
+	Priority      Priority      `json:"priority,string"`
+	Bytes         int64         `json:"bytes,string,omitempty"`
 }
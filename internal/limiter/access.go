@@ -0,0 +1,300 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+)
+
+const accessComponent string = "access"
+
+const (
+	accessReasonConfig  string = "config"
+	accessReasonAdmin   string = "admin"
+	accessReasonPenalty string = "penalty"
+)
+
+// accessEntry is an allowlist or blocklist entry, if expires is zero, the
+// entry never expires
+type accessEntry struct {
+	reason  string
+	expires time.Time
+}
+
+func (e accessEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// penalty counts the consecutive rejections of a key since the first one
+type penalty struct {
+	rejections int
+	since      time.Time
+}
+
+// Access is an allowlist and blocklist evaluated before any limiter runs:
+// allowed keys bypass the limiter and blocked keys are rejected with 403; a
+// key is in at most one of the lists. If the penalty box is configured, a
+// key is blocked once it's been rejected by the limiter a number of times
+// in a row within a window
+type Access struct {
+	sync.Mutex
+	config struct {
+		penaltyRejections int
+		penaltyWindow     time.Duration
+		penaltyDuration   time.Duration
+	}
+	logger    *logger.Logger
+	allowed   map[string]accessEntry
+	blocked   map[string]accessEntry
+	penalties map[string]*penalty
+	pruned    time.Time
+}
+
+func NewAccess(parameters ...any) *Access {
+	a := &Access{
+		allowed:   make(map[string]accessEntry),
+		blocked:   make(map[string]accessEntry),
+		penalties: make(map[string]*penalty),
+	}
+	var allowlist, blocklist map[string]time.Duration
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *config.Configuration:
+			a.config.penaltyRejections = p.PenaltyRejections
+			a.config.penaltyWindow = p.PenaltyWindow
+			a.config.penaltyDuration = p.PenaltyDuration
+			allowlist, blocklist = p.Allowlist, p.Blocklist
+		case *logger.Logger:
+			a.logger = p
+		}
+	}
+	a.logger = a.logger.Component(accessComponent)
+	for id, duration := range allowlist {
+		a.allow(id, duration, accessReasonConfig)
+	}
+	for id, duration := range blocklist {
+		a.block(id, duration, accessReasonConfig)
+	}
+	return a
+}
+
+func expires(duration time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(duration)
+}
+
+func (a *Access) allow(id string, duration time.Duration, reason string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.blocked, id)
+	delete(a.penalties, id)
+	a.allowed[id] = accessEntry{reason: reason, expires: expires(duration)}
+}
+
+func (a *Access) block(id string, duration time.Duration, reason string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.allowed, id)
+	delete(a.penalties, id)
+	a.blocked[id] = accessEntry{reason: reason, expires: expires(duration)}
+}
+
+// Allow adds the id to the allowlist (removing it from the blocklist) for
+// the given duration, if the duration is zero, it never expires
+func (a *Access) Allow(id string, duration time.Duration) {
+	a.allow(id, duration, accessReasonAdmin)
+	a.logger.Info("allowlisted", "id", id, "duration", duration)
+}
+
+// Block adds the id to the blocklist (removing it from the allowlist) for
+// the given duration, if the duration is zero, it never expires
+func (a *Access) Block(id string, duration time.Duration) {
+	a.block(id, duration, accessReasonAdmin)
+	a.logger.Info("blocklisted", "id", id, "duration", duration)
+}
+
+// Remove removes the id from both the allowlist and the blocklist
+func (a *Access) Remove(id string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.allowed, id)
+	delete(a.blocked, id)
+	delete(a.penalties, id)
+	a.logger.Info("removed", "id", id)
+}
+
+// List returns the entries of the allowlist and the blocklist that haven't
+// expired, sorted by key
+func (a *Access) List() *data.Access {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	list := func(entries map[string]accessEntry) []data.AccessEntry {
+		list := []data.AccessEntry{}
+		for id, e := range entries {
+			if e.expired(now) {
+				delete(entries, id)
+				continue
+			}
+			entry := data.AccessEntry{Key: id, Reason: e.reason}
+			if !e.expires.IsZero() {
+				expires := e.expires
+				entry.Expires = &expires
+			}
+			list = append(list, entry)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+		return list
+	}
+	return &data.Access{
+		Allowed: list(a.allowed),
+		Blocked: list(a.blocked),
+	}
+}
+
+// Lookup returns whether the id is allowed or blocked, and if blocked, how
+// long until the entry expires (zero if it never does)
+func (a *Access) Lookup(id string) (allowed, blocked bool, remaining time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	if e, ok := a.allowed[id]; ok {
+		if !e.expired(now) {
+			return true, false, 0
+		}
+		delete(a.allowed, id)
+	}
+	if e, ok := a.blocked[id]; ok {
+		if !e.expired(now) {
+			if !e.expires.IsZero() {
+				remaining = e.expires.Sub(now)
+			}
+			return false, true, remaining
+		}
+		delete(a.blocked, id)
+	}
+	return false, false, 0
+}
+
+// rejected counts a rejection of the id by the limiter, once the id has been
+// rejected the configured number of times in a row within the window, it's
+// blocked for the penalty duration
+func (a *Access) rejected(id string) {
+	if a.config.penaltyRejections <= 0 {
+		return
+	}
+	a.Lock()
+	now := time.Now()
+	a.prunePenalties(now)
+	p, ok := a.penalties[id]
+	if !ok || now.Sub(p.since) > a.config.penaltyWindow {
+		p = &penalty{since: now}
+		a.penalties[id] = p
+	}
+	p.rejections++
+	rejections := p.rejections
+	a.Unlock()
+	if rejections < a.config.penaltyRejections {
+		return
+	}
+	a.block(id, a.config.penaltyDuration, accessReasonPenalty)
+	a.logger.Warn("penalty box", "id", id, "rejections", rejections, "duration", a.config.penaltyDuration)
+}
+
+// prunePenalties removes the rejections counted for keys whose window has
+// passed, so keys that stopped being rejected don't accumulate; it scans at
+// most once per window and the caller is expected to hold the lock
+func (a *Access) prunePenalties(now time.Time) {
+	if now.Sub(a.pruned) < a.config.penaltyWindow {
+		return
+	}
+	a.pruned = now
+	for id, p := range a.penalties {
+		if now.Sub(p.since) > a.config.penaltyWindow {
+			delete(a.penalties, id)
+		}
+	}
+}
+
+// admitted resets the consecutive rejections of the id
+func (a *Access) admitted(id string) {
+	if a.config.penaltyRejections <= 0 {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.penalties, id)
+}
+
+// Observe feeds the penalty box with a decision made by the limiter for the
+// id (outside of the middleware, e.g. a decision-only check)
+func (a *Access) Observe(id string, limited bool) {
+	if limited {
+		a.rejected(id)
+		return
+	}
+	a.admitted(id)
+}
+
+type admittedKey struct{}
+
+// Middleware evaluates the allowlist and blocklist before the limiter's
+// middleware: allowed requests execute next directly, blocked requests are
+// rejected with 403 (and a Retry-After if the entry expires) and the rest
+// are given to the limiter; rejections by the limiter (a 429 written without
+// executing next) feed the penalty box, a 429 written by next doesn't
+func (a *Access) Middleware(l Limiter, next http.HandlerFunc) http.HandlerFunc {
+	limited := l.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		if admitted, ok := r.Context().Value(admittedKey{}).(*bool); ok {
+			*admitted = true
+		}
+		next(w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, ok := readBody(w, r, a.logger)
+		if !ok {
+			return
+		}
+		request := data.NewRequest()
+		_ = request.UnmarshalBinary(bodyBytes)
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		allowed, blocked, remaining := a.Lookup(request.ApplicationId)
+		switch {
+		case allowed:
+			a.logger.Decision("allowlisted", "id", request.ApplicationId)
+			next(w, r)
+		case blocked:
+			a.logger.Decision("blocked", "id", request.ApplicationId)
+			bytes := []byte("application is blocked")
+			if remaining > 0 {
+				w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(remaining.Seconds()))))
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
+			w.WriteHeader(http.StatusForbidden)
+			writeBytes(w, a.logger, bytes)
+		default:
+			var admitted bool
+			recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			limited(recorder, r.WithContext(context.WithValue(r.Context(), admittedKey{}, &admitted)))
+			a.Observe(request.ApplicationId, !admitted && recorder.statusCode == http.StatusTooManyRequests)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package limiter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+)
+
+// serveAccess executes the handler with a request for the id and returns the
+// response
+func serveAccess(handler http.HandlerFunc, id string) *httptest.ResponseRecorder {
+	body, _ := (&data.Request{ApplicationId: id, Weight: 1}).MarshalBinary()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return w
+}
+
+// TestAccessAllowlist verifies that an allowlisted key bypasses the limiter
+// while other keys are limited
+func TestAccessAllowlist(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 1
+	c.TokenReplinish = time.Hour
+	c.Allowlist = map[string]time.Duration{"allowed": 0}
+	l := NewToken(c)
+	defer l.Stop()
+	a := NewAccess(c)
+	handler := a.Middleware(l, func(w http.ResponseWriter, r *http.Request) {})
+
+	for i := range 3 {
+		if w := serveAccess(handler, "allowed"); w.Code != http.StatusOK {
+			t.Fatalf("expected allowlisted request %d to be allowed, got %d", i, w.Code)
+		}
+	}
+	if w := serveAccess(handler, "id"); w.Code != http.StatusOK {
+		t.Fatalf("expected the first request to be allowed, got %d", w.Code)
+	}
+	if w := serveAccess(handler, "id"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be limited, got %d", w.Code)
+	}
+}
+
+// TestAccessBlocklist verifies that a blocked key is rejected with 403 and a
+// Retry-After rounded up to the entry's expiration, and that it's allowed
+// once removed
+func TestAccessBlocklist(t *testing.T) {
+	c := config.NewConfiguration()
+	c.TokenReplinish = time.Hour
+	l := NewToken(c)
+	defer l.Stop()
+	a := NewAccess(c)
+	handler := a.Middleware(l, func(w http.ResponseWriter, r *http.Request) {})
+
+	a.Block("id", 1500*time.Millisecond)
+	w := serveAccess(handler, "id")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Fatalf("expected a Retry-After of 2, got %q", retryAfter)
+	}
+	a.Block("id", 0)
+	if w := serveAccess(handler, "id"); w.Header().Get("Retry-After") != "" {
+		t.Fatal("expected no Retry-After for an entry that never expires")
+	}
+	a.Remove("id")
+	if w := serveAccess(handler, "id"); w.Code != http.StatusOK {
+		t.Fatalf("expected a removed key to be allowed, got %d", w.Code)
+	}
+}
+
+// TestAccessPenaltyBox verifies that a key rejected by the limiter the
+// configured number of times in a row is blocked, while 429s written by the
+// handler aren't counted
+func TestAccessPenaltyBox(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 3
+	c.TokenReplinish = time.Hour
+	c.PenaltyRejections = 2
+	c.PenaltyWindow = time.Minute
+	c.PenaltyDuration = time.Minute
+	l := NewToken(c)
+	defer l.Stop()
+	a := NewAccess(c)
+	handler := a.Middleware(l, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	//the handler's 429s are admitted by the limiter, so they don't count
+	for i := range 3 {
+		if w := serveAccess(handler, "id"); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected request %d to be executed, got %d", i, w.Code)
+		}
+	}
+	if _, blocked, _ := a.Lookup("id"); blocked {
+		t.Fatal("expected the handler's 429s not to feed the penalty box")
+	}
+	//the bucket is empty, so the limiter rejects the next two
+	for range 2 {
+		_ = serveAccess(handler, "id")
+	}
+	if w := serveAccess(handler, "id"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the key to be in the penalty box, got %d", w.Code)
+	}
+}
+
+// TestAccessPenaltiesPruned verifies that the rejections counted for a key
+// are removed once its window passes
+func TestAccessPenaltiesPruned(t *testing.T) {
+	c := config.NewConfiguration()
+	c.PenaltyRejections = 2
+	c.PenaltyWindow = 10 * time.Millisecond
+	a := NewAccess(c)
+
+	a.Observe("stale", true)
+	time.Sleep(2 * c.PenaltyWindow)
+	a.Observe("id", true)
+	a.Lock()
+	_, ok := a.penalties["stale"]
+	a.Unlock()
+	if ok {
+		t.Fatal("expected the penalties of a key whose window passed to be pruned")
+	}
+}
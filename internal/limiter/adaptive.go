@@ -0,0 +1,139 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const adaptiveComponent string = "adaptive"
+
+// adaptive is a concurrency limiter whose limit isn't static, it's adjusted
+// using additive increase/multiplicative decrease (AIMD): every request that
+// completes within the target latency (without a server error) increases the
+// limit by 1/limit (roughly one per limit's worth of requests) while a
+// request that's too slow or fails multiplies the limit by the backoff; the
+// limit is decreased at most once per window (the target latency) since the
+// requests in flight when it's decreased were admitted by the previous limit
+type adaptive struct {
+	sync.Mutex
+	middlewareOptions
+	config struct {
+		minLimit      float64
+		maxLimit      float64
+		targetLatency time.Duration
+		backoff       float64
+	}
+	limit     float64
+	inFlight  int
+	waiters   waiters
+	decreased time.Time
+	now       func() time.Time
+}
+
+func NewAdaptive(parameters ...any) Limiter {
+	a := &adaptive{
+		middlewareOptions: newMiddlewareOptions(),
+		now:               time.Now,
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			a.logger = p
+		case *Metrics:
+			a.metrics = p
+		case Policy:
+			a.policy = p
+		case trace.TracerProvider:
+			a.tracer = p.Tracer(tracerName)
+		case *config.Configuration:
+			a.fromConfig(p)
+			a.limit = float64(p.AdaptiveInitialLimit)
+			a.config.minLimit = float64(p.AdaptiveMinLimit)
+			a.config.maxLimit = float64(p.AdaptiveMaxLimit)
+			a.config.targetLatency = p.AdaptiveLatency
+			a.config.backoff = p.AdaptiveBackoff
+		}
+	}
+	a.logger = a.logger.Component(adaptiveComponent)
+	if a.config.minLimit < 1 {
+		a.config.minLimit = 1
+	}
+	a.limit = max(a.config.minLimit, min(a.limit, a.config.maxLimit))
+	return a
+}
+
+func (a *adaptive) Limit(ctx context.Context, id string, parameters ...any) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.inFlight >= int(a.limit) {
+		a.logger.Decision("limited", "id", id, "in_flight", a.inFlight, "limit", int(a.limit))
+		return true
+	}
+	a.inFlight++
+	a.logger.Decision("allowed", "id", id, "in_flight", a.inFlight, "limit", int(a.limit))
+	return false
+}
+
+func (a *adaptive) Wait(ctx context.Context, id string, cost int64) error {
+	a.Lock()
+	if a.waiters.len() == 0 && a.admit(cost) {
+		a.Unlock()
+		return nil
+	}
+	element := a.waiters.push(cost)
+	a.Unlock()
+	return wait(ctx, a, &a.waiters, element, func() { a.Release(id) })
+}
+
+// admit admits a waiter if the number in flight is below the limit, the
+// caller is expected to hold the lock
+func (a *adaptive) admit(int64) bool {
+	if a.inFlight >= int(a.limit) {
+		return false
+	}
+	a.inFlight++
+	return true
+}
+
+func (a *adaptive) Release(id string) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.inFlight--
+	a.waiters.admit(a.admit)
+}
+
+func (a *adaptive) observe(id string, elapsed time.Duration, statusCode int) {
+	a.Lock()
+	defer a.Unlock()
+
+	switch {
+	case statusCode >= http.StatusInternalServerError, elapsed > a.config.targetLatency:
+		now := a.now()
+		if now.Sub(a.decreased) < a.config.targetLatency {
+			return
+		}
+		a.decreased = now
+		a.limit = max(a.config.minLimit, a.limit*a.config.backoff)
+		a.logger.Info("limit decreased", "limit", int(a.limit), "latency", elapsed, "status_code", statusCode)
+	default:
+		a.limit = min(a.config.maxLimit, a.limit+1/a.limit)
+		a.waiters.admit(a.admit)
+	}
+}
+
+func (a *adaptive) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(a, LimiterTypeAdaptive, a.middlewareOptions, next)
+}
+
+func (a *adaptive) Stop() {
+	a.logger.Info("stopped")
+}
@@ -0,0 +1,86 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestAdaptiveConverges simulates a server that can handle a number of
+// concurrent requests within the target latency (latency grows linearly once
+// it's saturated) and verifies that the limit settles around that capacity
+// rather than collapsing to the minimum or growing to the maximum; the
+// capacity drops and then recovers partway through, so the limit has to back
+// off and converge again each time
+func TestAdaptiveConverges(t *testing.T) {
+	const rounds = 400
+
+	c := config.NewConfiguration()
+	c.AdaptiveInitialLimit = 1
+	c.AdaptiveMinLimit = 1
+	c.AdaptiveMaxLimit = 64
+	c.AdaptiveLatency = 100 * time.Millisecond
+	c.AdaptiveBackoff = 0.9
+	a := NewAdaptive(c).(*adaptive)
+	defer a.Stop()
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	for _, capacity := range []int{16, 6, 24} {
+		latency := func(inFlight int) time.Duration {
+			if inFlight <= capacity {
+				return c.AdaptiveLatency / 2
+			}
+			return c.AdaptiveLatency * time.Duration(inFlight) / time.Duration(capacity)
+		}
+		lo, hi := float64(c.AdaptiveMaxLimit), float64(0)
+		for round := 0; round < rounds; round++ {
+			//admit as many requests as the limit allows, they all complete
+			// with the latency of the server at that concurrency
+			var admitted int
+			for !a.Limit(context.Background(), "id") {
+				admitted++
+			}
+			elapsed := latency(admitted)
+			for i := 0; i < admitted; i++ {
+				a.observe("id", elapsed, http.StatusOK)
+				a.Release("id")
+			}
+			now = now.Add(c.AdaptiveLatency)
+			if round >= rounds/2 {
+				lo, hi = min(lo, a.limit), max(hi, a.limit)
+			}
+		}
+		if lo < float64(capacity)*c.AdaptiveBackoff*c.AdaptiveBackoff || hi > float64(capacity)+2 {
+			t.Fatalf("expected limit to settle around %d, it ranged from %.2f to %.2f", capacity, lo, hi)
+		}
+	}
+}
+
+// TestAdaptiveBacksOffOncePerWindow verifies that a burst of slow responses
+// within a window only decreases the limit once
+func TestAdaptiveBacksOffOncePerWindow(t *testing.T) {
+	c := config.NewConfiguration()
+	c.AdaptiveInitialLimit = 32
+	c.AdaptiveLatency = 100 * time.Millisecond
+	c.AdaptiveBackoff = 0.5
+	a := NewAdaptive(c).(*adaptive)
+	defer a.Stop()
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		a.observe("id", time.Second, http.StatusOK)
+	}
+	if a.limit != 16 {
+		t.Fatalf("expected limit to be 16 after one window, got %.2f", a.limit)
+	}
+	now = now.Add(c.AdaptiveLatency)
+	a.observe("id", time.Second, http.StatusOK)
+	if a.limit != 8 {
+		t.Fatalf("expected limit to be 8 after two windows, got %.2f", a.limit)
+	}
+}
@@ -0,0 +1,55 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// grant is temporary extra capacity for a key
+type grant struct {
+	tokens  int64
+	expires time.Time
+}
+
+// grants are the grants by key, the caller is expected to hold the
+// limiter's lock
+type grants map[string]grant
+
+// extra returns the extra capacity granted to the given id, if any
+func (g grants) extra(id string) int64 {
+	if gr, ok := g[id]; ok && time.Now().Before(gr.expires) {
+		return gr.tokens
+	}
+	return 0
+}
+
+// expire removes the grants that have expired
+func (g grants) expire() {
+	now := time.Now()
+	for id, gr := range g {
+		if !now.Before(gr.expires) {
+			delete(g, id)
+		}
+	}
+}
+
+// lastSeen records when the middleware last saw each key
+type lastSeen struct {
+	sync.Map
+}
+
+func (l *lastSeen) touch(id string) {
+	if l == nil {
+		return
+	}
+	l.Store(id, time.Now())
+}
+
+func (l *lastSeen) load(id string) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	v, _ := l.Load(id)
+	t, _ := v.(time.Time)
+	return t
+}
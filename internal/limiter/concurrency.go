@@ -0,0 +1,241 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const concurrencyComponent string = "concurrency"
+
+// semaphore is a counting semaphore implemented with a buffered channel, a
+// slot is acquired by sending and released by receiving; refs is the number
+// of requests holding (or trying to acquire) a slot, it's guarded by the
+// limiter's lock
+type semaphore struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+	refs    int
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{slots: make(chan struct{}, size)}
+}
+
+// acquire attempts to acquire a slot, if no slot is available and the queue
+// isn't full, it'll wait (in FIFO order) until the deadline (if any) or ctx
+// is done
+func (s *semaphore) acquire(ctx context.Context, queueSize int, deadline <-chan time.Time) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if queueSize <= 0 {
+		return false
+	}
+	if s.waiting.Add(1) > int64(queueSize) {
+		s.waiting.Add(-1)
+		return false
+	}
+	defer s.waiting.Add(-1)
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-deadline:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *semaphore) release() {
+	<-s.slots
+}
+
+type concurrency struct {
+	sync.Mutex
+	middlewareOptions
+	config struct {
+		maxInFlight       int
+		maxInFlightGlobal int
+		queueSize         int
+		queueTimeout      time.Duration
+	}
+	global     *semaphore
+	semaphores map[string]*semaphore
+}
+
+func NewConcurrency(parameters ...any) Limiter {
+	c := &concurrency{
+		middlewareOptions: newMiddlewareOptions(),
+		semaphores:        make(map[string]*semaphore),
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			c.logger = p
+		case *Metrics:
+			c.metrics = p
+		case Policy:
+			c.policy = p
+		case trace.TracerProvider:
+			c.tracer = p.Tracer(tracerName)
+		case *config.Configuration:
+			c.fromConfig(p)
+			c.config.maxInFlight = p.MaxInFlight
+			c.config.maxInFlightGlobal = p.MaxInFlightGlobal
+			c.config.queueSize = p.InFlightQueueSize
+			c.config.queueTimeout = p.InFlightQueueTimeout
+		}
+	}
+	c.logger = c.logger.Component(concurrencyComponent)
+	if c.config.maxInFlight < 1 {
+		c.logger.Warn("max in flight must be at least 1, using default",
+			"max_in_flight", c.config.maxInFlight, "default", config.DefaultMaxInFlight)
+		c.config.maxInFlight = config.DefaultMaxInFlight
+	}
+	if c.config.maxInFlightGlobal > 0 {
+		c.global = newSemaphore(c.config.maxInFlightGlobal)
+	}
+	return c
+}
+
+// acquireSemaphore returns the semaphore for the given id and takes a
+// reference to it, the reference must be dropped (with dropSemaphore) once
+// the request is limited or released
+func (c *concurrency) acquireSemaphore(id string) *semaphore {
+	c.Lock()
+	defer c.Unlock()
+
+	s, ok := c.semaphores[id]
+	if !ok {
+		s = newSemaphore(c.config.maxInFlight)
+		c.semaphores[id] = s
+	}
+	s.refs++
+	return s
+}
+
+// dropSemaphore drops a reference to the semaphore for the given id, once
+// there are no references (the key is idle), it's evicted
+func (c *concurrency) dropSemaphore(id string, s *semaphore) {
+	c.Lock()
+	defer c.Unlock()
+
+	if s.refs--; s.refs <= 0 && c.semaphores[id] == s {
+		delete(c.semaphores, id)
+	}
+}
+
+// Limit acquires an in-flight slot for the given id (and the global slot if
+// configured), the slot is held until Release is called
+func (c *concurrency) Limit(ctx context.Context, id string, parameters ...any) bool {
+	tTimeout := time.NewTimer(c.config.queueTimeout)
+	defer tTimeout.Stop()
+	s := c.acquireSemaphore(id)
+	if !s.acquire(ctx, c.config.queueSize, tTimeout.C) {
+		c.dropSemaphore(id, s)
+		c.logger.Decision("limited", "id", id, "in_flight", len(s.slots))
+		return true
+	}
+	if c.global != nil && !c.global.acquire(ctx, c.config.queueSize, tTimeout.C) {
+		s.release()
+		c.dropSemaphore(id, s)
+		c.logger.Decision("limited", "id", id, "in_flight_global", len(c.global.slots))
+		return true
+	}
+	c.logger.Decision("allowed", "id", id, "in_flight", len(s.slots))
+	return false
+}
+
+// Wait blocks until an in-flight slot is acquired for the given id (and the
+// global slot if configured), it waits in the same bounded queue as Limit
+// (but without the timeout) and fails if the queue is full
+func (c *concurrency) Wait(ctx context.Context, id string, cost int64) error {
+	s := c.acquireSemaphore(id)
+	if !s.acquire(ctx, c.config.queueSize, nil) {
+		c.dropSemaphore(id, s)
+		return queueErr(ctx)
+	}
+	if c.global != nil && !c.global.acquire(ctx, c.config.queueSize, nil) {
+		s.release()
+		c.dropSemaphore(id, s)
+		return queueErr(ctx)
+	}
+	return nil
+}
+
+// queueErr returns why a slot couldn't be acquired: ctx is done or the queue
+// is full
+func queueErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrQueueFull
+}
+
+// Release releases the slot held for the given id, the semaphore of a key
+// is evicted once it doesn't have any slots in use or waiters
+func (c *concurrency) Release(id string) {
+	c.Lock()
+	s, ok := c.semaphores[id]
+	c.Unlock()
+	if !ok {
+		c.logger.Warn("release without a slot", "id", id)
+		return
+	}
+	s.release()
+	c.dropSemaphore(id, s)
+	if c.global != nil {
+		c.global.release()
+	}
+}
+
+func (c *concurrency) Keys() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	keys := make([]string, 0, len(c.semaphores))
+	for id := range c.semaphores {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// KeyState returns the in-flight slots in use for the given id
+func (c *concurrency) KeyState(id string) *data.KeyState {
+	c.Lock()
+	defer c.Unlock()
+
+	sem, ok := c.semaphores[id]
+	if !ok {
+		return nil
+	}
+	s := &data.KeyState{
+		Key:         id,
+		Tokens:      int64(cap(sem.slots) - len(sem.slots)),
+		QueueLength: int(sem.waiting.Load()),
+		LastSeen:    c.seen.load(id),
+	}
+	if cap(sem.slots) > 0 {
+		s.Fill = float64(len(sem.slots)) / float64(cap(sem.slots))
+	}
+	return s
+}
+
+func (c *concurrency) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(c, LimiterTypeConcurrency, c.middlewareOptions, next)
+}
+
+func (c *concurrency) Stop() {
+	c.logger.Info("stopped")
+}
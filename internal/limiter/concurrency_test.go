@@ -0,0 +1,42 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestConcurrencyWaitQueueFull verifies that Wait waits in the bounded queue
+// and fails once the queue is full rather than waiting regardless
+func TestConcurrencyWaitQueueFull(t *testing.T) {
+	c := config.NewConfiguration()
+	c.MaxInFlight = 1
+	c.MaxInFlightGlobal = 0
+	c.InFlightQueueSize = 1
+	l := NewConcurrency(c)
+	defer l.Stop()
+	ctx := context.Background()
+
+	if err := l.Wait(ctx, "id", 1); err != nil {
+		t.Fatalf("expected a slot, got %v", err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- l.Wait(ctx, "id", 1) }()
+	//give the waiter time to queue
+	time.Sleep(50 * time.Millisecond)
+	if err := l.Wait(ctx, "id", 1); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+	l.(Releaser).Release("id")
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("expected the queued waiter to get the slot, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued waiter to get the slot")
+	}
+}
@@ -0,0 +1,311 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const fairComponent string = "fair"
+
+type fairRequest struct {
+	cost     int64
+	admitted chan struct{}
+}
+
+// fair is an admission scheduler that queues requests per id and serves the
+// queues using deficit round robin (DRR); every service interval the budget
+// (the cost that can be admitted per interval) is spent visiting the active
+// queues in turn: each visit increases the queue's deficit by the quantum and
+// requests are admitted from it as long as their cost (weight) fits within
+// the deficit. The round continues where the previous interval stopped, so
+// when there's contention, each id gets the same share of the budget
+// regardless of how many requests it sends. Unlike the leaky bucket, a single
+// id can only fill its own queue, so it can't starve the others
+type fair struct {
+	sync.Mutex
+	sync.WaitGroup
+	middlewareOptions
+	config struct {
+		queueSize   int
+		quantum     int64
+		budget      int64
+		serviceRate time.Duration
+	}
+	stopper  chan struct{}
+	queues   map[string]*list.List
+	deficits map[string]int64
+	active   []string
+	next     int
+	visiting string
+	served   atomic.Int64
+}
+
+func NewFair(parameters ...any) Limiter {
+	f := &fair{
+		middlewareOptions: newMiddlewareOptions(),
+		queues:            make(map[string]*list.List),
+		deficits:          make(map[string]int64),
+		stopper:           make(chan struct{}),
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			f.logger = p
+		case *Metrics:
+			f.metrics = p
+		case Policy:
+			f.policy = p
+		case trace.TracerProvider:
+			f.tracer = p.Tracer(tracerName)
+		case *config.Configuration:
+			f.fromConfig(p)
+			f.config.queueSize = p.FairQueueSize
+			f.config.quantum = p.FairQuantum
+			f.config.budget = p.FairBudget
+			f.config.serviceRate = p.FairServiceRate
+		}
+	}
+	//a quantum or budget that isn't positive would never admit anything
+	f.config.quantum = max(f.config.quantum, 1)
+	f.config.budget = max(f.config.budget, 1)
+	f.logger = f.logger.Component(fairComponent)
+	f.served.Store(time.Now().UnixNano())
+	f.launchScheduler()
+	return f
+}
+
+// serve spends the budget of a service interval, visiting the active queues
+// in turn (starting where the previous interval stopped) and admitting
+// requests from each while their cost fits within its deficit; a visit that
+// runs out of budget is resumed in the next interval without adding another
+// quantum. A request that costs more than the whole budget is admitted on its
+// own at the start of an interval. The interval ends early if every active
+// queue was visited without admitting anything (their deficits grow by a
+// quantum per interval until their requests fit). Queues that are emptied are
+// removed from the round and lose their deficit
+func (f *fair) serve() {
+	f.Lock()
+	defer f.Unlock()
+
+	budget := f.config.budget
+	for idle := 0; budget > 0 && len(f.active) > 0 && idle < len(f.active); {
+		if f.next >= len(f.active) {
+			f.next = 0
+		}
+		id := f.active[f.next]
+		queue := f.queues[id]
+		if f.visiting != id {
+			f.visiting = id
+			f.deficits[id] += f.config.quantum
+		}
+		idle++
+		for queue.Len() > 0 {
+			element := queue.Front()
+			request := element.Value.(*fairRequest)
+			if request.cost > f.deficits[id] {
+				break
+			}
+			if request.cost > budget && budget < f.config.budget {
+				return
+			}
+			f.deficits[id] -= request.cost
+			budget -= request.cost
+			idle = 0
+			queue.Remove(element)
+			close(request.admitted)
+		}
+		f.visiting = ""
+		if queue.Len() == 0 {
+			f.deactivate(id)
+			continue
+		}
+		f.next++
+	}
+}
+
+// deactivate removes the given id from the round along with its queue and
+// deficit, the caller is expected to hold the lock
+func (f *fair) deactivate(id string) {
+	delete(f.queues, id)
+	delete(f.deficits, id)
+	if f.visiting == id {
+		f.visiting = ""
+	}
+	for i := range f.active {
+		if f.active[i] == id {
+			f.active = append(f.active[:i], f.active[i+1:]...)
+			if i < f.next {
+				f.next--
+			}
+			return
+		}
+	}
+}
+
+func (f *fair) launchScheduler() {
+	f.Add(1)
+	started := make(chan struct{})
+	go func() {
+		defer f.Done()
+
+		tService := time.NewTicker(f.config.serviceRate)
+		defer tService.Stop()
+		close(started)
+		for {
+			select {
+			case <-f.stopper:
+				return
+			case <-tService.C:
+				f.serve()
+				f.served.Store(time.Now().UnixNano())
+			}
+		}
+	}()
+	<-started
+}
+
+// enqueue adds a request to the queue for the given id, if bounded is true
+// the request isn't enqueued if the queue is full
+func (f *fair) enqueue(id string, cost int64, bounded bool) (*list.Element, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	queue, ok := f.queues[id]
+	if !ok {
+		queue = list.New()
+		f.queues[id] = queue
+	}
+	if bounded && queue.Len() >= f.config.queueSize {
+		return nil, false
+	}
+	if queue.Len() == 0 {
+		f.active = append(f.active, id)
+	}
+	return queue.PushBack(&fairRequest{
+		cost:     cost,
+		admitted: make(chan struct{}),
+	}), true
+}
+
+// cancel removes a request from its queue if it hasn't been admitted yet, it
+// returns true if the request was admitted in the meantime
+func (f *fair) cancel(id string, element *list.Element) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	request := element.Value.(*fairRequest)
+	select {
+	case <-request.admitted:
+		return true
+	default:
+	}
+	queue := f.queues[id]
+	queue.Remove(element)
+	if queue.Len() == 0 {
+		f.deactivate(id)
+	}
+	return false
+}
+
+func (f *fair) Limit(ctx context.Context, id string, parameters ...any) bool {
+	var cost int64 = 1
+
+	for _, parameter := range parameters {
+		if i, ok := parameter.(int64); ok && i > 0 {
+			cost = i
+		}
+	}
+	element, ok := f.enqueue(id, cost, true)
+	if !ok {
+		f.logger.Decision("limited", "id", id, "reason", "queue full")
+		return true
+	}
+	if err := f.wait(ctx, id, element); err != nil {
+		f.logger.Decision("limited while queued", "id", id, "error", err)
+		return true
+	}
+	f.logger.Decision("allowed", "id", id, "cost", cost)
+	return false
+}
+
+// Wait enqueues the request regardless of whether the queue for the given
+// id is full and blocks until it's admitted by the scheduler
+func (f *fair) Wait(ctx context.Context, id string, cost int64) error {
+	element, _ := f.enqueue(id, max(cost, 1), false)
+	return f.wait(ctx, id, element)
+}
+
+func (f *fair) wait(ctx context.Context, id string, element *list.Element) error {
+	select {
+	case <-element.Value.(*fairRequest).admitted:
+		return nil
+	case <-ctx.Done():
+		if f.cancel(id, element) {
+			return nil
+		}
+		return ctx.Err()
+	case <-f.stopper:
+		return errors.New("stopped")
+	}
+}
+
+func (f *fair) Keys() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	keys := make([]string, 0, len(f.queues))
+	for id := range f.queues {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// KeyState returns how full the queue for the given id is, if the queue is
+// unbounded, its fill is always zero
+func (f *fair) KeyState(id string) *data.KeyState {
+	f.Lock()
+	defer f.Unlock()
+
+	queue, ok := f.queues[id]
+	if !ok {
+		return nil
+	}
+	s := &data.KeyState{
+		Key:         id,
+		QueueLength: queue.Len(),
+		LastSeen:    f.seen.load(id),
+	}
+	if f.config.queueSize > 0 {
+		s.Tokens = int64(f.config.queueSize - queue.Len())
+		s.Fill = float64(queue.Len()) / float64(f.config.queueSize)
+	}
+	return s
+}
+
+func (f *fair) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(f, LimiterTypeFair, f.middlewareOptions, next)
+}
+
+func (f *fair) Check(ctx context.Context) error {
+	if err := checkStopper(f.stopper); err != nil {
+		return err
+	}
+	return checkStalled(&f.served, f.config.serviceRate)
+}
+
+func (f *fair) Stop() {
+	close(f.stopper)
+	f.WaitGroup.Wait()
+	f.logger.Info("stopped")
+}
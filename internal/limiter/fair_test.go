@@ -0,0 +1,168 @@
+package limiter
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// jainsIndex returns Jain's fairness index of the allocations, it's 1 when
+// every allocation is the same and 1/n when a single one gets everything
+func jainsIndex(allocations []float64) float64 {
+	var sum, sumOfSquares float64
+
+	for _, x := range allocations {
+		sum += x
+		sumOfSquares += x * x
+	}
+	if sumOfSquares == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(allocations)) * sumOfSquares)
+}
+
+func admitted(elements []*list.Element) int {
+	var n int
+
+	for _, element := range elements {
+		select {
+		case <-element.Value.(*fairRequest).admitted:
+			n++
+		default:
+		}
+	}
+	return n
+}
+
+// enqueueAll enqueues the given number of requests (costing one) per id in
+// the order of the ids, so that's the order of the round
+func enqueueAll(f *fair, ids []string, demand map[string]int) map[string][]*list.Element {
+	elements := make(map[string][]*list.Element)
+	for _, id := range ids {
+		for i := 0; i < demand[id]; i++ {
+			element, _ := f.enqueue(id, 1, false)
+			elements[id] = append(elements[id], element)
+		}
+	}
+	return elements
+}
+
+// TestFairJainsIndex enqueues a skewed load (one application sending ten
+// times as many requests as the others) with a budget that can't serve every
+// application each interval and verifies that the budget caps what's
+// admitted while every application gets the same share of it
+func TestFairJainsIndex(t *testing.T) {
+	const rounds = 10
+
+	c := config.NewConfiguration()
+	c.FairQuantum = 1
+	c.FairBudget = 2
+	c.FairServiceRate = time.Hour //intervals are run by the test
+	f := NewFair(c).(*fair)
+	defer f.Stop()
+
+	ids := []string{"heavy", "light1", "light2", "light3"}
+	demand := map[string]int{"heavy": 200, "light1": 20, "light2": 20, "light3": 20}
+	elements := enqueueAll(f, ids, demand)
+	for i := 0; i < rounds; i++ {
+		f.serve()
+	}
+	var allocations []float64
+	var total int
+	for _, id := range ids {
+		n := admitted(elements[id])
+		if expected := rounds * int(c.FairBudget) / len(ids); n != expected {
+			t.Errorf("expected %s to be admitted %d times, got %d", id, expected, n)
+		}
+		allocations = append(allocations, float64(n))
+		total += n
+	}
+	if expected := rounds * int(c.FairBudget); total != expected {
+		t.Fatalf("expected the budget to cap admissions at %d, got %d", expected, total)
+	}
+	if j := jainsIndex(allocations); j < 0.99 {
+		t.Fatalf("expected Jain's fairness index close to 1, got %.3f (%v)", j, allocations)
+	}
+}
+
+// TestFairHeavyUsesSpareBudget verifies that the heavy application is held
+// to its share while the light ones are backlogged and gets the whole budget
+// once they're served, their queues are removed once they're empty
+func TestFairHeavyUsesSpareBudget(t *testing.T) {
+	const rounds = 10
+
+	c := config.NewConfiguration()
+	c.FairQuantum = 1
+	c.FairBudget = 4
+	c.FairServiceRate = time.Hour
+	f := NewFair(c).(*fair)
+	defer f.Stop()
+
+	ids := []string{"heavy", "light1", "light2", "light3"}
+	demand := map[string]int{"heavy": 100, "light1": 2, "light2": 2, "light3": 2}
+	elements := enqueueAll(f, ids, demand)
+	f.serve()
+	if n := admitted(elements["heavy"]); n != 1 {
+		t.Fatalf("expected heavy to get a quarter of the budget with contention, got %d", n)
+	}
+	for i := 1; i < rounds; i++ {
+		f.serve()
+	}
+	//the light applications are served in the first two intervals, after
+	// which heavy is alone
+	if n, expected := admitted(elements["heavy"]), 2+(rounds-2)*int(c.FairBudget); n != expected {
+		t.Fatalf("expected heavy to be admitted %d times, got %d", expected, n)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if len(f.queues) != 1 || len(f.deficits) != 1 {
+		t.Fatalf("expected only the queue of heavy to be left, got %d queues", len(f.queues))
+	}
+}
+
+// TestFairRoundContinues verifies that an interval that runs out of budget
+// is continued by the next interval where it stopped rather than starting
+// over, so every application is served in turn
+func TestFairRoundContinues(t *testing.T) {
+	c := config.NewConfiguration()
+	c.FairQuantum = 1
+	c.FairBudget = 3
+	c.FairServiceRate = time.Hour
+	f := NewFair(c).(*fair)
+	defer f.Stop()
+
+	ids := []string{"a", "b", "c", "d", "e"}
+	elements := enqueueAll(f, ids, map[string]int{"a": 3, "b": 3, "c": 3, "d": 3, "e": 3})
+	f.serve()
+	f.serve()
+	for id, expected := range map[string]int{"a": 2, "b": 1, "c": 1, "d": 1, "e": 1} {
+		if n := admitted(elements[id]); n != expected {
+			t.Fatalf("expected %s to be admitted %d times, got %d", id, expected, n)
+		}
+	}
+}
+
+// TestFairCostExceedsBudget verifies that a request that costs more than the
+// budget is admitted on its own once its deficit has grown enough
+func TestFairCostExceedsBudget(t *testing.T) {
+	c := config.NewConfiguration()
+	c.FairQuantum = 2
+	c.FairBudget = 4
+	c.FairServiceRate = time.Hour
+	f := NewFair(c).(*fair)
+	defer f.Stop()
+
+	element, _ := f.enqueue("id", 6, false)
+	for i := 0; i < 2; i++ {
+		f.serve()
+		if admitted([]*list.Element{element}) != 0 {
+			t.Fatalf("expected the request not to be admitted after %d intervals", i+1)
+		}
+	}
+	f.serve()
+	if admitted([]*list.Element{element}) != 1 {
+		t.Fatal("expected the request to be admitted once its deficit covers its cost")
+	}
+}
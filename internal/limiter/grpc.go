@@ -0,0 +1,173 @@
+package limiter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultGrpcMetadataKey is the metadata key the interceptors read the rate
+// limit key from if no other key is provided
+const DefaultGrpcMetadataKey GrpcMetadataKey = "application-id"
+
+// GrpcMetadataKey is the metadata key the interceptors read the rate limit
+// key from, if it's missing, the peer's address (without the port) is used
+type GrpcMetadataKey string
+
+// GrpcMessageLimiter is a limiter applied to every message received on a
+// stream (as opposed to the stream's creation), receiving a message waits
+// until it's admitted
+type GrpcMessageLimiter struct {
+	Limiter
+}
+
+type grpcOptions struct {
+	metadataKey     GrpcMetadataKey
+	messageLimiter  Limiter
+	decisionTimeout time.Duration
+}
+
+func newGrpcOptions(parameters ...any) grpcOptions {
+	options := grpcOptions{
+		metadataKey:     DefaultGrpcMetadataKey,
+		decisionTimeout: config.DefaultDecisionTimeout,
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *config.Configuration:
+			options.decisionTimeout = p.DecisionTimeout
+		case GrpcMetadataKey:
+			options.metadataKey = p
+		case GrpcMessageLimiter:
+			options.messageLimiter = p.Limiter
+		}
+	}
+	return options
+}
+
+// key returns the rate limit key of a call from its metadata or its peer
+func (o grpcOptions) key(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(string(o.metadataKey)); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// resourceExhausted returns a ResourceExhausted status with retry info if
+// the limiter can tell how long until the key could be admitted
+func resourceExhausted(l Limiter, id string, message string) error {
+	s := status.New(codes.ResourceExhausted, message)
+	retryAfter, ok := RetryAfter(l, id)
+	if !ok {
+		return s.Err()
+	}
+	if d, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		s = d
+	}
+	return s.Err()
+}
+
+// limit executes the limiter for a call (waiting at most timeout for limiters
+// that wait for capacity), it returns a function that must be executed once
+// the call is done (to release and observe the call)
+func limit(ctx context.Context, l Limiter, id string, timeout time.Duration) (func(error), error) {
+	if Decide(ctx, l, id, timeout, int64(1), data.PriorityNormal) {
+		return nil, resourceExhausted(l, id, "too many requests received")
+	}
+	tStart := time.Now()
+	return func(err error) {
+		if observer, ok := l.(observer); ok {
+			statusCode := http.StatusOK
+			if err != nil {
+				statusCode = http.StatusInternalServerError
+			}
+			observer.observe(id, time.Since(tStart), statusCode)
+		}
+		if releaser, ok := l.(Releaser); ok {
+			releaser.Release(id)
+		}
+	}, nil
+}
+
+// UnaryServerInterceptor applies the limiter to every unary call, limited
+// calls fail with ResourceExhausted
+func UnaryServerInterceptor(l Limiter, parameters ...any) grpc.UnaryServerInterceptor {
+	options := newGrpcOptions(parameters...)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		done, err := limit(ctx, l, options.key(ctx), options.decisionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		done(err)
+		return resp, err
+	}
+}
+
+// limitedStream limits the rate of messages received on a stream
+type limitedStream struct {
+	grpc.ServerStream
+	limiter Limiter
+	id      string
+	timeout time.Duration
+}
+
+// RecvMsg waits at most the decision timeout for the message to be admitted
+// before receiving it
+func (s *limitedStream) RecvMsg(m any) error {
+	ctx, cancel := context.WithTimeout(s.Context(), s.timeout)
+	err := s.limiter.Wait(ctx, s.id, 1)
+	cancel()
+	if err != nil {
+		if ctxErr := s.Context().Err(); ctxErr != nil {
+			return status.FromContextError(ctxErr).Err()
+		}
+		return resourceExhausted(s.limiter, s.id, err.Error())
+	}
+	if releaser, ok := s.limiter.(Releaser); ok {
+		defer releaser.Release(s.id)
+	}
+	return s.ServerStream.RecvMsg(m)
+}
+
+// StreamServerInterceptor applies the limiter to the creation of every
+// stream (limited streams fail with ResourceExhausted), if a message limiter
+// is provided, every message received on the stream waits (at most the
+// decision timeout) to be admitted by it
+func StreamServerInterceptor(l Limiter, parameters ...any) grpc.StreamServerInterceptor {
+	options := newGrpcOptions(parameters...)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		id := options.key(ss.Context())
+		done, err := limit(ss.Context(), l, id, options.decisionTimeout)
+		if err != nil {
+			return err
+		}
+		if options.messageLimiter != nil {
+			ss = &limitedStream{ServerStream: ss, limiter: options.messageLimiter,
+				id: id, timeout: options.decisionTimeout}
+		}
+		err = handler(srv, ss)
+		done(err)
+		return err
+	}
+}
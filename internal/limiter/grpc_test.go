@@ -0,0 +1,200 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	grpcTestUnary  string = "/limiter.Test/Unary"
+	grpcTestStream string = "/limiter.Test/Stream"
+)
+
+// grpcTestStreamDesc is a bidirectional stream that echoes every message it
+// receives
+var grpcTestStreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	ServerStreams: true,
+	ClientStreams: true,
+	Handler: func(srv any, stream grpc.ServerStream) error {
+		for {
+			m := &emptypb.Empty{}
+			if err := stream.RecvMsg(m); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+			if err := stream.SendMsg(m); err != nil {
+				return err
+			}
+		}
+	},
+}
+
+// grpcTestService is a service without generated code with a unary method
+// and a stream
+var grpcTestService = grpc.ServiceDesc{
+	ServiceName: "limiter.Test",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Unary",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := &emptypb.Empty{}
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return &emptypb.Empty{}, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: grpcTestUnary}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{grpcTestStreamDesc},
+}
+
+// newGrpcClient serves the test service with the interceptors on an
+// in-process listener and returns a connection to it
+func newGrpcClient(t *testing.T, l Limiter, parameters ...any) *grpc.ClientConn {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(l, parameters...)),
+		grpc.StreamInterceptor(StreamServerInterceptor(l, parameters...)),
+	)
+	server.RegisterService(&grpcTestService, struct{}{})
+	go func() { _ = server.Serve(listener) }()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		server.Stop()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		server.Stop()
+	})
+	return conn
+}
+
+// newGrpcToken returns a token bucket of the given capacity that isn't
+// replenished during the test
+func newGrpcToken(t *testing.T, c *config.Configuration, capacity int64) Limiter {
+	t.Helper()
+
+	c.Maxtokens = capacity
+	c.TokenReplinish = time.Hour
+	l := NewToken(c)
+	t.Cleanup(l.Stop)
+	return l
+}
+
+func grpcContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(),
+		string(DefaultGrpcMetadataKey), "application_id")
+}
+
+// TestGrpcUnaryResourceExhausted verifies that a limited unary call fails with
+// ResourceExhausted and the retry delay of the limiter
+func TestGrpcUnaryResourceExhausted(t *testing.T) {
+	c := config.NewConfiguration()
+	conn := newGrpcClient(t, newGrpcToken(t, c, 1))
+	ctx := grpcContext()
+
+	if err := conn.Invoke(ctx, grpcTestUnary, &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatalf("expected the first call to be allowed, got %v", err)
+	}
+	err := conn.Invoke(ctx, grpcTestUnary, &emptypb.Empty{}, &emptypb.Empty{})
+	s := status.Convert(err)
+	if s.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected %s, got %v", codes.ResourceExhausted, err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range s.Details() {
+		if d, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = d
+		}
+	}
+	if retryInfo == nil || retryInfo.GetRetryDelay().AsDuration() <= 0 {
+		t.Fatalf("expected a retry delay, got %v", s.Details())
+	}
+}
+
+// TestGrpcStreamCreation verifies that the creation of streams is limited
+func TestGrpcStreamCreation(t *testing.T) {
+	c := config.NewConfiguration()
+	conn := newGrpcClient(t, newGrpcToken(t, c, 1))
+	ctx, cancel := context.WithCancel(grpcContext())
+	defer cancel()
+
+	for i, code := range []codes.Code{codes.OK, codes.ResourceExhausted} {
+		stream, err := conn.NewStream(ctx, &grpcTestStreamDesc, grpcTestStream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.SendMsg(&emptypb.Empty{}); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		err = stream.RecvMsg(&emptypb.Empty{})
+		if s := status.Convert(err); s.Code() != code {
+			t.Fatalf("expected stream %d to be %s, got %v", i, code, err)
+		}
+	}
+}
+
+// TestGrpcMessageLimiter verifies that every message received on a stream is
+// limited by the message limiter and that a message that can't be admitted
+// fails the stream once the decision timeout passes rather than waiting for
+// capacity
+func TestGrpcMessageLimiter(t *testing.T) {
+	c := config.NewConfiguration()
+	c.DecisionTimeout = 10 * time.Millisecond
+	messageLimiter := newGrpcToken(t, config.NewConfiguration(), 2)
+	conn := newGrpcClient(t, newGrpcToken(t, c, 1), c,
+		GrpcMessageLimiter{Limiter: messageLimiter})
+	ctx, cancel := context.WithTimeout(grpcContext(), 5*time.Second)
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &grpcTestStreamDesc, grpcTestStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			t.Fatalf("expected message %d to be allowed, got %v", i, err)
+		}
+	}
+	if err := stream.SendMsg(&emptypb.Empty{}); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	err = stream.RecvMsg(&emptypb.Empty{})
+	if s := status.Convert(err); s.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected %s, got %v", codes.ResourceExhausted, err)
+	}
+}
@@ -0,0 +1,37 @@
+package limiter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stalledIntervals is how many intervals the goroutine that replenishes (or
+// drains) a limiter can miss before the limiter is considered stalled
+const stalledIntervals = 3
+
+// checkStopper returns ErrStopped if the stopper has been closed, once it
+// is, the goroutines that replenish (or drain) the limiter have exited
+func checkStopper(stopper chan struct{}) error {
+	select {
+	case <-stopper:
+		return ErrStopped
+	default:
+		return nil
+	}
+}
+
+// checkStalled returns ErrStalled if the goroutine that replenishes (or
+// drains) the limiter every interval hasn't done so for a few intervals,
+// last is when it last did (in unix nanoseconds); this catches a goroutine
+// that has died or is stuck even though the limiter wasn't stopped
+func checkStalled(last *atomic.Int64, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	if age := time.Since(time.Unix(0, last.Load())); age > stalledIntervals*interval {
+		return errors.Wrapf(ErrStalled, "last executed %v ago", age.Round(time.Millisecond))
+	}
+	return nil
+}
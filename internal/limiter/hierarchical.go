@@ -0,0 +1,416 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const hierarchicalComponent string = "hierarchical"
+
+// hierarchical is a token bucket where each bucket can have a parent (e.g.
+// application → organization → plan); a request consumes its cost from its
+// own bucket and from every ancestor atomically, so a parent can't exceed its
+// capacity even if each of its children are within theirs. If borrowing is
+// enabled, a child without enough tokens can borrow the shortfall from its
+// parent (the parent pays for the request and the shortfall)
+type hierarchical struct {
+	sync.Mutex
+	sync.WaitGroup
+	middlewareOptions
+	config struct {
+		maxTokens         int64
+		replinishInterval time.Duration
+		parents           map[string]string
+		limits            map[string]int64
+		borrow            bool
+		carryDebt         bool
+	}
+	stopper     chan struct{}
+	buckets     map[string]int64
+	waiters     map[string]*waiters
+	grants      grants
+	replinished atomic.Int64
+}
+
+func NewHierarchical(parameters ...any) Limiter {
+	h := &hierarchical{
+		middlewareOptions: newMiddlewareOptions(),
+		grants:            make(grants),
+		buckets:           make(map[string]int64),
+		waiters:           make(map[string]*waiters),
+		stopper:           make(chan struct{}),
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			h.logger = p
+		case *Metrics:
+			h.metrics = p
+		case Policy:
+			h.policy = p
+		case trace.TracerProvider:
+			h.tracer = p.Tracer(tracerName)
+		case *config.Configuration:
+			h.fromConfig(p)
+			h.config.maxTokens = p.Maxtokens
+			h.config.replinishInterval = p.TokenReplinish
+			h.config.parents = p.Hierarchy
+			h.config.limits = p.HierarchyLimits
+			h.config.borrow = p.HierarchyBorrow
+			h.config.carryDebt = p.CarryDebt
+		}
+	}
+	h.logger = h.logger.Component(hierarchicalComponent)
+	h.replinished.Store(time.Now().UnixNano())
+	h.launchReplinish()
+	return h
+}
+
+// capacity returns the capacity of the bucket for the given id including any
+// extra capacity granted, the caller is expected to hold the lock
+func (h *hierarchical) capacity(id string) int64 {
+	if i, ok := h.config.limits[id]; ok {
+		return i + h.grants.extra(id)
+	}
+	return h.config.maxTokens + h.grants.extra(id)
+}
+
+// chain returns the given id followed by its ancestors, ordered from child
+// to root; cycles in the configuration are broken at the first repeated id
+func (h *hierarchical) chain(id string) []string {
+	seen := make(map[string]struct{})
+	chain := []string{}
+	for ok := true; ok; id, ok = h.config.parents[id] {
+		if _, repeated := seen[id]; repeated {
+			break
+		}
+		seen[id] = struct{}{}
+		chain = append(chain, id)
+	}
+	return chain
+}
+
+// tokens returns the tokens in the bucket for the given id, the caller is
+// expected to hold the lock
+func (h *hierarchical) tokens(id string) int64 {
+	i, ok := h.buckets[id]
+	if !ok {
+		i = h.capacity(id)
+		h.buckets[id] = i
+	}
+	return i
+}
+
+func (h *hierarchical) replinish() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.grants.expire()
+	for id, tokens := range h.buckets {
+		if !h.config.carryDebt {
+			h.buckets[id] = h.capacity(id)
+			continue
+		}
+		h.buckets[id] = max(min(tokens+h.capacity(id), h.capacity(id)), tokens)
+	}
+	h.admit()
+	h.replinished.Store(time.Now().UnixNano())
+}
+
+// admit admits the waiters of every id in FIFO order, the caller is
+// expected to hold the lock
+func (h *hierarchical) admit() {
+	for id, w := range h.waiters {
+		w.admitWaiters(func(waiter *waiter) bool {
+			charges, ok := h.consume(id, waiter.cost)
+			waiter.charges = charges
+			return ok
+		})
+	}
+}
+
+func (h *hierarchical) launchReplinish() {
+	h.Add(1)
+	started := make(chan struct{})
+	go func() {
+		defer h.Done()
+
+		tReplinish := time.NewTicker(h.config.replinishInterval)
+		defer tReplinish.Stop()
+		close(started)
+		for {
+			select {
+			case <-h.stopper:
+				return
+			case <-tReplinish.C:
+				h.replinish()
+			}
+		}
+	}()
+	<-started
+}
+
+// charges determines how many tokens to take from each bucket in the chain
+// for a request of the given cost, it returns false if any bucket (after
+// borrowing) doesn't have enough tokens; the caller is expected to hold the lock
+func (h *hierarchical) charges(chain []string, cost int64) (map[string]int64, bool) {
+	charges := make(map[string]int64, len(chain))
+	need := cost
+	for i, id := range chain {
+		tokens := h.tokens(id)
+		switch {
+		case tokens >= need:
+			charges[id] = need
+			need = cost
+		case h.config.borrow && i < len(chain)-1:
+			charges[id] = max(tokens, 0)
+			need = cost + need - charges[id]
+		default:
+			return nil, false
+		}
+	}
+	return charges, true
+}
+
+func (h *hierarchical) Limit(ctx context.Context, id string, parameters ...any) bool {
+	var cost int64 = 1
+
+	for _, parameter := range parameters {
+		if i, ok := parameter.(int64); ok {
+			cost = max(i, 1) //a cost that isn't positive would add tokens
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	charges, ok := h.consume(id, cost)
+	if !ok {
+		h.logger.Decision("limited", "id", id, "chain", h.chain(id))
+		return true
+	}
+	findReceipt(parameters...).record(h, charges)
+	h.logger.Decision("allowed", "id", id, "tokens", h.buckets[id])
+	return false
+}
+
+// consume takes the cost from the bucket of the given id and its ancestors
+// if they all have enough tokens, it returns what each bucket was charged;
+// the caller is expected to hold the lock
+func (h *hierarchical) consume(id string, cost int64) (map[string]int64, bool) {
+	charges, ok := h.charges(h.chain(id), cost)
+	if !ok {
+		return nil, false
+	}
+	for id, charge := range charges {
+		h.buckets[id] -= charge
+	}
+	return charges, true
+}
+
+// refund returns what each bucket was charged (without exceeding their
+// capacity), the caller is expected to hold the lock
+func (h *hierarchical) refund(charges map[string]int64) {
+	for id, charge := range charges {
+		h.buckets[id] = min(h.tokens(id)+charge, h.capacity(id))
+	}
+}
+
+// Balance returns the smallest balance of the bucket of the given id and its
+// ancestors
+func (h *hierarchical) Balance(id string) int64 {
+	h.Lock()
+	defer h.Unlock()
+
+	chain := h.chain(id)
+	balance := h.tokens(chain[0])
+	for _, id := range chain[1:] {
+		balance = min(balance, h.tokens(id))
+	}
+	return balance
+}
+
+// Charge takes the cost from the bucket of the given id and its ancestors,
+// overdrawing them if necessary
+func (h *hierarchical) Charge(id string, cost int64) {
+	h.Lock()
+	defer h.Unlock()
+
+	chain := h.chain(id)
+	if cost < 0 {
+		charges := make(map[string]int64)
+		for _, id := range chain {
+			charges[id] = -cost
+		}
+		h.refund(charges)
+		h.admit()
+		return
+	}
+	for _, id := range chain {
+		h.buckets[id] = h.tokens(id) - cost
+	}
+}
+
+// Refund returns what the request took from the bucket of the given id and
+// its ancestors (without exceeding their capacity); if a receipt is given
+// (e.g. by the middleware), each bucket gets back exactly what it was
+// charged (a child that borrowed paid less than the cost and its parent paid
+// the shortfall), otherwise the cost is returned to each bucket
+func (h *hierarchical) Refund(id string, parameters ...any) {
+	var cost int64 = 1
+
+	for _, parameter := range parameters {
+		if i, ok := parameter.(int64); ok {
+			cost = max(i, 0) //negative costs would take tokens
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	if r := findReceipt(parameters...); r != nil {
+		if charges, ok := r.take(h); ok {
+			h.refund(charges)
+		}
+		return
+	}
+	charges := make(map[string]int64)
+	for _, id := range h.chain(id) {
+		charges[id] = cost
+	}
+	h.refund(charges)
+}
+
+// admissible returns false if a request of the given cost could never be
+// admitted, regardless of how many tokens are in the buckets
+func (h *hierarchical) admissible(id string, cost int64) bool {
+	chain := h.chain(id)
+	if h.config.borrow {
+		return cost <= h.capacity(chain[len(chain)-1])
+	}
+	for _, id := range chain {
+		if cost > h.capacity(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait blocks until the cost can be taken from the bucket of the given id and
+// its ancestors, waiters for a given id are admitted in FIFO order each time
+// the buckets are replenished
+func (h *hierarchical) Wait(ctx context.Context, id string, cost int64) error {
+	cost = max(cost, 1) //a cost that isn't positive would add tokens
+	h.Lock()
+	if !h.admissible(id, cost) {
+		h.Unlock()
+		return ErrCostExceedsCapacity
+	}
+	w, ok := h.waiters[id]
+	if !ok {
+		w = &waiters{}
+		h.waiters[id] = w
+	}
+	if w.len() == 0 {
+		if _, ok := h.consume(id, cost); ok {
+			h.Unlock()
+			return nil
+		}
+	}
+	element := w.push(cost)
+	h.Unlock()
+	h.logger.Decision("waiting", "id", id, "cost", cost)
+	return wait(ctx, h, w, element, func() {
+		h.Lock()
+		defer h.Unlock()
+
+		h.refund(element.Value.(*waiter).charges)
+		h.admit()
+	})
+}
+
+func (h *hierarchical) retryAfter(id string) time.Duration {
+	return h.config.replinishInterval
+}
+
+// Reset fills the bucket for the given id (but not its ancestors) and
+// removes any grant
+func (h *hierarchical) Reset(id string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.grants, id)
+	h.buckets[id] = h.capacity(id)
+	h.admit()
+	h.logger.Info("reset", "id", id)
+}
+
+// Grant increases the capacity of the bucket for the given id (and adds the
+// tokens to it) until the duration elapses, the capacity of its ancestors
+// isn't increased
+func (h *hierarchical) Grant(id string, tokens int64, duration time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.grants[id] = grant{tokens: tokens, expires: time.Now().Add(duration)}
+	h.buckets[id] = min(h.tokens(id)+tokens, h.capacity(id))
+	h.admit()
+	h.logger.Info("granted", "id", id, "tokens", tokens, "duration", duration)
+}
+
+func (h *hierarchical) Keys() []string {
+	h.Lock()
+	defer h.Unlock()
+
+	keys := make([]string, 0, len(h.buckets))
+	for id := range h.buckets {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+func (h *hierarchical) KeyState(id string) *data.KeyState {
+	h.Lock()
+	defer h.Unlock()
+
+	tokens, ok := h.buckets[id]
+	if !ok {
+		return nil
+	}
+	s := &data.KeyState{
+		Key:      id,
+		Tokens:   tokens,
+		LastSeen: h.seen.load(id),
+	}
+	if capacity := h.capacity(id); capacity > 0 {
+		s.Fill = float64(max(tokens, 0)) / float64(capacity)
+	}
+	if w, ok := h.waiters[id]; ok {
+		s.QueueLength = w.len()
+	}
+	return s
+}
+
+func (h *hierarchical) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(h, LimiterTypeHierarchical, h.middlewareOptions, next)
+}
+
+func (h *hierarchical) Check(ctx context.Context) error {
+	if err := checkStopper(h.stopper); err != nil {
+		return err
+	}
+	return checkStalled(&h.replinished, h.config.replinishInterval)
+}
+
+func (h *hierarchical) Stop() {
+	close(h.stopper)
+	h.WaitGroup.Wait()
+	h.logger.Info("stopped")
+}
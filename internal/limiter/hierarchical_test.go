@@ -0,0 +1,85 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestHierarchicalRefundBorrowed verifies that a request that borrowed from
+// its parent is refunded exactly what each bucket was charged
+func TestHierarchicalRefundBorrowed(t *testing.T) {
+	c := config.NewConfiguration()
+	c.TokenReplinish = time.Hour
+	c.Hierarchy = map[string]string{"app": "org"}
+	c.HierarchyLimits = map[string]int64{"app": 2, "org": 10}
+	c.HierarchyBorrow = true
+	h := NewHierarchical(c).(*hierarchical)
+	defer h.Stop()
+
+	//the app has 2 tokens, so a request that costs 3 borrows 1 from the org
+	// which pays for the request and the shortfall
+	r := newReceipt()
+	if h.Limit(context.Background(), "app", int64(3), r) {
+		t.Fatal("expected request to be admitted by borrowing")
+	}
+	if app, org := h.buckets["app"], h.buckets["org"]; app != 0 || org != 6 {
+		t.Fatalf("expected app=0 and org=6 after borrowing, got app=%d and org=%d", app, org)
+	}
+	h.Refund("app", int64(3), r)
+	if app, org := h.buckets["app"], h.buckets["org"]; app != 2 || org != 10 {
+		t.Fatalf("expected app=2 and org=10 after the refund, got app=%d and org=%d", app, org)
+	}
+
+	//the receipt can only be refunded once
+	h.Limit(context.Background(), "app", int64(1))
+	h.Refund("app", int64(3), r)
+	if app, org := h.buckets["app"], h.buckets["org"]; app != 1 || org != 9 {
+		t.Fatalf("expected app=1 and org=9 after a repeated refund, got app=%d and org=%d", app, org)
+	}
+}
+
+// TestHierarchicalNonPositiveCost verifies that a cost that isn't positive is
+// charged as one rather than adding tokens to the bucket and its ancestors
+func TestHierarchicalNonPositiveCost(t *testing.T) {
+	c := config.NewConfiguration()
+	c.TokenReplinish = time.Hour
+	c.Hierarchy = map[string]string{"app": "org"}
+	c.HierarchyLimits = map[string]int64{"app": 2, "org": 10}
+	h := NewHierarchical(c).(*hierarchical)
+	defer h.Stop()
+
+	if h.Limit(context.Background(), "app", int64(-5)) {
+		t.Fatal("expected the request to be admitted")
+	}
+	if app, org := h.buckets["app"], h.buckets["org"]; app != 1 || org != 9 {
+		t.Fatalf("expected app=1 and org=9, got app=%d and org=%d", app, org)
+	}
+}
+
+// TestHierarchicalCarryDebt verifies that debt is forgiven when the buckets
+// are replenished unless CARRY_DEBT is set
+func TestHierarchicalCarryDebt(t *testing.T) {
+	for _, test := range []struct {
+		carryDebt bool
+		expected  int64
+	}{
+		{carryDebt: false, expected: 2},
+		{carryDebt: true, expected: -1},
+	} {
+		c := config.NewConfiguration()
+		c.TokenReplinish = time.Hour
+		c.CarryDebt = test.carryDebt
+		c.HierarchyLimits = map[string]int64{"app": 2}
+		h := NewHierarchical(c).(*hierarchical)
+
+		h.Charge("app", 5)
+		h.replinish()
+		if app := h.Balance("app"); app != test.expected {
+			t.Errorf("expected app=%d after replenishing with carry debt %t, got %d", test.expected, test.carryDebt, app)
+		}
+		h.Stop()
+	}
+}
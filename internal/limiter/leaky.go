@@ -1,22 +1,23 @@
 package limiter
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
 
 	goqueue "github.com/antonio-alexander/go-queue"
 	"github.com/antonio-alexander/go-queue/finite"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const leakyBucketPrefix string = "[leaky_bucket] "
+const leakyBucketComponent string = "leaky_bucket"
 
 type queue interface {
 	goqueue.Owner
@@ -32,31 +33,140 @@ type queue interface {
 	finite.Capacity
 }
 
+// leakyQueue is the bucket for a given id, reserved is the number of slots
+// that have been reserved and will be placed in the queue as it leaks while
+// waiters are blocked in Wait until there's room for them in the queue
+type leakyQueue struct {
+	sync.Mutex
+	queue
+	reserved atomic.Int64
+	waiters  waiters
+	leaked   atomic.Int64
+}
+
+// place enqueues the given number of slots if there's room for all of them,
+// each slot is the given item (e.g. the receipt of the request so its slots
+// can be found again); the caller is expected to hold the lock
+func (q *leakyQueue) place(slots int64, slot any) bool {
+	if int64(q.Capacity()-q.Length()) < slots {
+		return false
+	}
+	for ; slots > 0; slots-- {
+		q.Enqueue(slot)
+	}
+	return true
+}
+
+// admit gives the free slots to the waiters in FIFO order, the caller is
+// expected to hold the lock
+func (q *leakyQueue) admit() {
+	q.waiters.admitWaiters(func(w *waiter) bool { return q.place(w.cost, w.slot) })
+}
+
+// release removes the slots of a request from the queue: if the request's
+// slots are identifiable (by its receipt) only the slots it still has in the
+// queue are removed (none if they've already leaked), otherwise the given
+// number of slots are removed from the front; the caller is expected to hold
+// the lock
+func (q *leakyQueue) release(slots int64, slot any) {
+	if _, ok := slot.(*receipt); !ok {
+		for ; slots > 0; slots-- {
+			q.Dequeue()
+		}
+		return
+	}
+	items := q.Flush()
+	remaining := make([]any, 0, len(items))
+	for _, item := range items {
+		if item != slot {
+			remaining = append(remaining, item)
+		}
+	}
+	q.EnqueueMultiple(remaining)
+}
+
 type leakyBucket struct {
 	sync.RWMutex
 	sync.WaitGroup
+	middlewareOptions
 	stopper   chan struct{}
-	buckets   map[string]queue
+	buckets   map[string]*leakyQueue
 	queueSize int
 	leakRate  time.Duration
 }
 
 func NewLeaky(parameters ...any) Limiter {
 	l := &leakyBucket{
-		buckets: make(map[string]queue),
-		stopper: make(chan struct{}),
+		middlewareOptions: newMiddlewareOptions(),
+		buckets:           make(map[string]*leakyQueue),
+		stopper:           make(chan struct{}),
 	}
 	for _, parameter := range parameters {
 		switch p := parameter.(type) {
+		case *logger.Logger:
+			l.logger = p
+		case *Metrics:
+			l.metrics = p
+		case Policy:
+			l.policy = p
+		case trace.TracerProvider:
+			l.tracer = p.Tracer(tracerName)
 		case *config.Configuration:
+			l.fromConfig(p)
 			l.queueSize = p.QueueSize
 			l.leakRate = p.LeakRate
 		}
 	}
+	l.logger = l.logger.Component(leakyBucketComponent)
 	return l
 }
 
-func (l *leakyBucket) launchHandler(q queue) {
+// takeReserved decrements the reserved count by up to n without going below
+// zero, it returns how many were taken
+func takeReserved(reserved *atomic.Int64, n int64) int64 {
+	for {
+		r := reserved.Load()
+		taken := min(r, n)
+		if taken <= 0 {
+			return 0
+		}
+		if reserved.CompareAndSwap(r, r-taken) {
+			return taken
+		}
+	}
+}
+
+// readBucket returns the bucket for the given id, creating it (and launching
+// its handler) if it doesn't exist
+func (l *leakyBucket) readBucket(id string) *leakyQueue {
+	l.Lock()
+	defer l.Unlock()
+
+	q, ok := l.buckets[id]
+	if !ok {
+		q = &leakyQueue{queue: finite.New(l.queueSize)}
+		q.leaked.Store(time.Now().UnixNano())
+		l.buckets[id] = q
+		l.launchHandler(q)
+	}
+	return q
+}
+
+// leak removes a slot from the queue, then gives the free slot to the
+// oldest reservation or, if there are none, to the waiters in FIFO order
+func (l *leakyBucket) leak(q *leakyQueue) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.Dequeue()
+	if takeReserved(&q.reserved, 1) > 0 {
+		q.Enqueue(struct{}{})
+		return
+	}
+	q.admit()
+}
+
+func (l *leakyBucket) launchHandler(q *leakyQueue) {
 	l.Add(1)
 	started := make(chan struct{})
 	go func() {
@@ -70,84 +180,167 @@ func (l *leakyBucket) launchHandler(q queue) {
 			case <-l.stopper:
 				return
 			case <-tLeakRate.C:
-				q.Dequeue()
+				l.leak(q)
+				q.leaked.Store(time.Now().UnixNano())
 			}
 		}
 	}()
 	<-started
 }
 
+// Limit places the request in the bucket, if the bucket is full it waits
+// until there's room for it; it's only limited if ctx is done first
 func (l *leakyBucket) Limit(ctx context.Context, id string, parameters ...any) bool {
-	l.Lock()
-	defer l.Unlock()
+	var slot any = struct{}{}
 
-	queue, ok := l.buckets[id]
-	if !ok {
-		queue = finite.New(l.queueSize)
-		l.buckets[id] = queue
-		l.launchHandler(queue)
-	}
-	if overflow := queue.Enqueue(struct{}{}); overflow {
-		fmt.Printf(leakyBucketPrefix+"%s limited (%d)\n", id, queue.Length())
-		for stop := false; stop; {
-			tEnqueue := time.NewTicker(time.Millisecond)
-			defer tEnqueue.Stop()
-			select {
-			case <-ctx.Done():
-				return true
-			case <-tEnqueue.C:
-				if overflow := queue.Enqueue(struct{}{}); !overflow {
-					stop = true
-				}
-			}
-		}
+	if r := findReceipt(parameters...); r != nil {
+		slot = r
 	}
-	fmt.Printf(leakyBucketPrefix+"%s allowed (%d)\n", id, queue.Length())
+	if err := l.wait(ctx, id, 1, slot); err != nil {
+		l.logger.Decision("limited", "id", id, "error", err)
+		return true
+	}
+	l.logger.Decision("allowed", "id", id)
 	return false
 }
 
-func (l *leakyBucket) Middleware(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//read the request from bytes
-		request := data.NewRequest()
-		bodyBytes, err := io.ReadAll(r.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			if _, err = w.Write([]byte(err.Error())); err != nil {
-				fmt.Printf(leakyBucketPrefix+"error while writing bytes: %s\n", err.Error())
-			}
-			return
+// Refund removes the request's slot from the bucket (if it hasn't leaked
+// yet), the free slot is given to the waiters (if any); without a receipt
+// the request's slot can't be identified and the oldest slot is removed
+func (l *leakyBucket) Refund(id string, parameters ...any) {
+	var slot any = struct{}{}
+
+	if r := findReceipt(parameters...); r != nil {
+		slot = r
+	}
+	q := l.readBucket(id)
+	q.Lock()
+	defer q.Unlock()
+
+	q.release(1, slot)
+	q.admit()
+}
+
+func (l *leakyBucket) Wait(ctx context.Context, id string, cost int64) error {
+	return l.wait(ctx, id, cost, struct{}{})
+}
+
+// wait places the cost in the bucket as the given slot, waiting until there's
+// room for it
+func (l *leakyBucket) wait(ctx context.Context, id string, cost int64, slot any) error {
+	if cost > int64(l.queueSize) {
+		return ErrCostExceedsCapacity
+	}
+	q := l.readBucket(id)
+	q.Lock()
+	if q.waiters.len() == 0 && q.reserved.Load() == 0 && q.place(cost, slot) {
+		q.Unlock()
+		return nil
+	}
+	element := q.waiters.push(cost)
+	element.Value.(*waiter).slot = slot
+	l.logger.Decision("waiting", "id", id, "queued", q.Length())
+	q.Unlock()
+	return wait(ctx, q, &q.waiters, element, func() {
+		q.Lock()
+		defer q.Unlock()
+		q.release(cost, slot)
+		q.admit()
+	})
+}
+
+// Reserve places as much of the cost as it can in the bucket (as long as
+// nobody has reserved ahead of it) and reserves the rest, reserved capacity
+// is placed in the bucket by the handler each time it leaks
+func (l *leakyBucket) Reserve(ctx context.Context, id string, cost int64) *Reservation {
+	var placed int64
+
+	if cost > int64(l.queueSize) {
+		return &Reservation{}
+	}
+	q := l.readBucket(id)
+	q.Lock()
+	defer q.Unlock()
+
+	for placed < cost && q.reserved.Load() == 0 && q.waiters.len() == 0 {
+		if overflow := q.Enqueue(struct{}{}); overflow {
+			break
 		}
-		_ = r.Body.Close()
-		if err := request.UnmarshalBinary(bodyBytes); err != nil {
-			if _, err = w.Write([]byte(err.Error())); err != nil {
-				fmt.Printf(leakyBucketPrefix+"error while writing bytes: %s\n", err.Error())
-			}
-			return
+		placed++
+	}
+	owed := cost - placed
+	delay := time.Duration(q.reserved.Add(owed)) * l.leakRate
+	if owed == 0 {
+		delay = 0
+	}
+	l.logger.Decision("reserved", "id", id, "cost", cost, "delay", delay)
+	return newReservation(delay, func() {
+		q.Lock()
+		defer q.Unlock()
+		for n := cost - takeReserved(&q.reserved, owed); n > 0; n-- {
+			q.Dequeue()
 		}
+	})
+}
 
-		//execute the rate limiter
-		if l.Limit(r.Context(), request.ApplicationId, int64(request.Weight)) {
-			bytes := []byte("too many requests received")
-			w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
-			w.WriteHeader(http.StatusTooManyRequests)
-			if _, err := w.Write(bytes); err != nil {
-				fmt.Printf(leakyBucketPrefix+"error while writing bytes: %s\n", err.Error())
-			}
-			return
-		}
+func (l *leakyBucket) Keys() []string {
+	l.RLock()
+	defer l.RUnlock()
 
-		//execute next endpoint
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		next(w, r)
-	})
+	keys := make([]string, 0, len(l.buckets))
+	for id := range l.buckets {
+		keys = append(keys, id)
+	}
+	return keys
 }
 
-func (l *leakyBucket) Stop() {
-	l.Lock()
-	defer l.Unlock()
+// KeyState returns how full the bucket for the given id is, for a leaky
+// bucket a full bucket means there's no room for more requests
+func (l *leakyBucket) KeyState(id string) *data.KeyState {
+	l.RLock()
+	q, ok := l.buckets[id]
+	l.RUnlock()
+	if !ok {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	s := &data.KeyState{
+		Key:         id,
+		Tokens:      int64(q.Capacity() - q.Length()),
+		QueueLength: q.waiters.len(),
+		LastSeen:    l.seen.load(id),
+	}
+	if q.Capacity() > 0 {
+		s.Fill = float64(q.Length()) / float64(q.Capacity())
+	}
+	return s
+}
 
+func (l *leakyBucket) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(l, LimiterTypeLeaky, l.middlewareOptions, next)
+}
+
+// Check checks that the limiter hasn't been stopped and that every bucket is
+// still leaking (each bucket has a goroutine of its own)
+func (l *leakyBucket) Check(ctx context.Context) error {
+	if err := checkStopper(l.stopper); err != nil {
+		return err
+	}
+	l.RLock()
+	defer l.RUnlock()
+
+	for id, q := range l.buckets {
+		if err := checkStalled(&q.leaked, l.leakRate); err != nil {
+			return errors.Wrapf(err, "bucket %s", id)
+		}
+	}
+	return nil
+}
+
+func (l *leakyBucket) Stop() {
 	close(l.stopper)
-	l.Wait()
-	fmt.Println(leakyBucketPrefix + "stopped")
+	l.WaitGroup.Wait()
+	l.logger.Info("stopped")
 }
@@ -0,0 +1,37 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestLeakyRefundOwnSlot verifies that a refund removes the request's own
+// slot from the bucket and nothing once that slot has leaked
+func TestLeakyRefundOwnSlot(t *testing.T) {
+	c := config.NewConfiguration()
+	c.QueueSize = 2
+	c.LeakRate = time.Hour
+	l := NewLeaky(c).(*leakyBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	first, second := newReceipt(), newReceipt()
+	if l.Limit(ctx, "id", int64(1), first) || l.Limit(ctx, "id", int64(1), second) {
+		t.Fatal("expected both requests to be placed in the bucket")
+	}
+	q := l.readBucket("id")
+	l.leak(q)
+	//the first request has leaked, refunding it mustn't free the second
+	// request's slot
+	l.Refund("id", int64(1), first)
+	if n := q.Length(); n != 1 {
+		t.Fatalf("expected the second request to still be in the bucket, got %d slots", n)
+	}
+	l.Refund("id", int64(1), second)
+	if n := q.Length(); n != 0 {
+		t.Fatalf("expected the second request to be removed, got %d slots", n)
+	}
+}
@@ -0,0 +1,163 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/metrics"
+)
+
+// keyLabelOther is the key label used once the number of keys with their own
+// label has reached the configured bound
+const keyLabelOther string = "other"
+
+const (
+	decisionAllowed string = "allowed"
+	decisionDenied  string = "denied"
+)
+
+// queueLengthBuckets are the upper bounds of the queue length histogram
+var queueLengthBuckets = []float64{0, 1, 2, 5, 10, 20, 50, 100}
+
+// Policy is the name of the policy a limiter enforces (e.g. "leaky:shadow"),
+// it's used to label metrics; if it's not provided the algorithm is used
+type Policy string
+
+func decision(limited bool) string {
+	if limited {
+		return decisionDenied
+	}
+	return decisionAllowed
+}
+
+type instrumented struct {
+	limiter   Limiter
+	algorithm LimiterType
+	policy    Policy
+}
+
+// Metrics are the limiter metrics, they're shared by every limiter that's
+// provided them and collected from the limiters when scraped
+type Metrics struct {
+	sync.Mutex
+	config struct {
+		keyLabels int
+	}
+	keyLabels   map[string]struct{}
+	limiters    []instrumented
+	decisions   *metrics.Counter
+	latency     *metrics.Histogram
+	queueLength *metrics.Histogram
+	fill        *metrics.Gauge
+	activeKeys  *metrics.Gauge
+}
+
+func NewMetrics(parameters ...any) *Metrics {
+	m := &Metrics{
+		keyLabels: make(map[string]struct{}),
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *config.Configuration:
+			m.config.keyLabels = p.MetricsKeyLabels
+		case *metrics.Registry:
+			m.decisions = p.NewCounter("rate_limiter_requests_total",
+				"Requests by rate limiter decision.", "algorithm", "policy", "decision", "key")
+			m.latency = p.NewHistogram("rate_limiter_handler_duration_seconds",
+				"Latency of the handler for admitted requests.", nil, "algorithm", "policy", "key")
+			m.queueLength = p.NewHistogram("rate_limiter_queue_length",
+				"Requests queued for the key when a decision is made.", queueLengthBuckets, "algorithm", "policy")
+			m.fill = p.NewGauge("rate_limiter_bucket_fill",
+				"Current fill of the buckets (from 0 to 1), averaged if keys share a label.", "algorithm", "policy", "key")
+			m.activeKeys = p.NewGauge("rate_limiter_active_keys",
+				"Number of keys the rate limiter has state for.", "algorithm", "policy")
+			p.OnCollect(m.collect)
+		}
+	}
+	return m
+}
+
+// key returns the label for the given key, keys are only labelled up to the
+// configured bound (after which they're labelled as other), if the bound is
+// zero, keys aren't labelled
+func (m *Metrics) key(id string) string {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.config.keyLabels <= 0 {
+		return ""
+	}
+	if _, ok := m.keyLabels[id]; ok {
+		return id
+	}
+	if len(m.keyLabels) >= m.config.keyLabels {
+		return keyLabelOther
+	}
+	m.keyLabels[id] = struct{}{}
+	return id
+}
+
+// register adds a limiter to be collected when scraped, a limiter is only
+// registered once
+func (m *Metrics) register(l Limiter, algorithm LimiterType, policy Policy) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, i := range m.limiters {
+		if i.limiter == l {
+			return
+		}
+	}
+	m.limiters = append(m.limiters, instrumented{l, algorithm, policy})
+}
+
+func (m *Metrics) decision(algorithm LimiterType, policy Policy, l Limiter, id string, limited bool) {
+	if m == nil || m.decisions == nil {
+		return
+	}
+	m.decisions.Add(1, string(algorithm), string(policy), decision(limited), m.key(id))
+	if inspector, ok := l.(Inspector); ok {
+		if s := inspector.KeyState(id); s != nil {
+			m.queueLength.Observe(float64(s.QueueLength), string(algorithm), string(policy))
+		}
+	}
+}
+
+func (m *Metrics) handled(algorithm LimiterType, policy Policy, id string, elapsed time.Duration) {
+	if m == nil || m.latency == nil {
+		return
+	}
+	m.latency.Observe(elapsed.Seconds(), string(algorithm), string(policy), m.key(id))
+}
+
+// collect sets the fill and active keys gauges from the current state of
+// every registered limiter
+func (m *Metrics) collect() {
+	m.Lock()
+	limiters := append([]instrumented{}, m.limiters...)
+	m.Unlock()
+	m.fill.Reset()
+	m.activeKeys.Reset()
+	for _, i := range limiters {
+		inspector, ok := i.limiter.(Inspector)
+		if !ok {
+			continue
+		}
+		keys := inspector.Keys()
+		fills, counts := make(map[string]float64), make(map[string]int)
+		for _, id := range keys {
+			s := inspector.KeyState(id)
+			if s == nil {
+				continue
+			}
+			key := m.key(id)
+			fills[key] += s.Fill
+			counts[key]++
+		}
+		for key, fill := range fills {
+			m.fill.Set(fill/float64(counts[key]), string(i.algorithm), string(i.policy), key)
+		}
+		m.activeKeys.Set(float64(len(keys)), string(i.algorithm), string(i.policy))
+	}
+}
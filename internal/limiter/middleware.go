@@ -0,0 +1,387 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// middlewareOptions is the configuration used by the middleware, it's
+// embedded by each limiter and populated from the configuration
+type middlewareOptions struct {
+	refundStatusCodes []string
+	costMode          string
+	costDurationUnit  time.Duration
+	costBytesUnit     int64
+	costTable         map[string]int64
+	weightMin         int64
+	weightMax         int64
+	metrics           *Metrics
+	policy            Policy
+	logger            *logger.Logger
+	tracer            trace.Tracer
+	seen              *lastSeen
+}
+
+func newMiddlewareOptions() middlewareOptions {
+	return middlewareOptions{seen: &lastSeen{}}
+}
+
+func (m *middlewareOptions) fromConfig(c *config.Configuration) {
+	m.refundStatusCodes = c.RefundStatusCodes
+	m.costMode = c.CostMode
+	m.costDurationUnit = c.CostDurationUnit
+	m.costBytesUnit = c.CostBytesUnit
+	m.costTable = c.CostTable
+	m.weightMin = c.WeightMin
+	m.weightMax = c.WeightMax
+}
+
+// validWeight returns false if the weight declared by the client is outside
+// of the allowed range
+func (m *middlewareOptions) validWeight(weight int64) bool {
+	return weight >= m.weightMin && weight <= m.weightMax
+}
+
+// requestCost returns the server-defined cost of a request from the cost
+// table, the most specific entry wins: method and route (e.g. "POST /wait"),
+// route (e.g. "/wait"), method (e.g. "POST") and finally request attributes
+// (e.g. "priority:2"); if there's no entry, the cost declared by the route
+// (if any) or the declared weight is used
+func (m *middlewareOptions) requestCost(r *http.Request, request *data.Request) int64 {
+	for _, key := range []string{
+		r.Method + " " + r.URL.Path,
+		r.URL.Path,
+		r.Method,
+		fmt.Sprintf("priority:%d", request.Priority),
+	} {
+		if cost, ok := m.costTable[key]; ok {
+			return cost
+		}
+	}
+	if cost, ok := r.Context().Value(requestCostKey{}).(int64); ok {
+		return cost
+	}
+	return request.Weight
+}
+
+// cost returns the cost of a handled request according to the cost mode,
+// partial units are rounded up
+func (m *middlewareOptions) cost(declared, handler int64, elapsed time.Duration, bytes int64) int64 {
+	switch m.costMode {
+	case CostModeDuration:
+		if m.costDurationUnit > 0 {
+			return int64((elapsed + m.costDurationUnit - 1) / m.costDurationUnit)
+		}
+	case CostModeBytes:
+		if m.costBytesUnit > 0 {
+			return (bytes + m.costBytesUnit - 1) / m.costBytesUnit
+		}
+	case CostModeHandler:
+		if handler >= 0 {
+			return handler
+		}
+	}
+	return declared
+}
+
+// refundable returns true if the status code matches one of the configured
+// refund status codes, these can be exact (e.g. 503) or a class (e.g. 5xx)
+func (m *middlewareOptions) refundable(statusCode int) bool {
+	code := strconv.Itoa(statusCode)
+	for _, s := range m.refundStatusCodes {
+		if strings.EqualFold(s, code) || (strings.HasSuffix(strings.ToLower(s), "xx") && s[:1] == code[:1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterer can be implemented by a limiter to populate the Retry-After
+// header when a request is limited
+type retryAfterer interface {
+	retryAfter(id string) time.Duration
+}
+
+// headerWriter can be implemented by a limiter to add headers to every
+// response (limited or not) once the limiter has been executed
+type headerWriter interface {
+	writeHeaders(id string, header http.Header)
+}
+
+// RetryAfter returns how long until a limited request for the given id
+// could be admitted, if the limiter can tell; it's used to make decisions
+// outside of the middleware (e.g. a decision service)
+func RetryAfter(l Limiter, id string) (time.Duration, bool) {
+	retryAfterer, ok := l.(retryAfterer)
+	if !ok {
+		return 0, false
+	}
+	return retryAfterer.retryAfter(id), true
+}
+
+// Decide executes the limiter for a decision made outside of the middleware
+// (e.g. a decision service), limiters that wait for capacity (e.g. leaky or
+// fair) wait at most timeout so a decision can't be held until the caller
+// gives up; a timeout of zero doesn't wait at all
+func Decide(ctx context.Context, l Limiter, id string, timeout time.Duration, parameters ...any) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return l.Limit(ctx, id, parameters...)
+}
+
+// WriteHeaders adds the headers the limiter adds to every response for the
+// given id (e.g. the quota headers) to header
+func WriteHeaders(l Limiter, id string, header http.Header) {
+	if h, ok := l.(headerWriter); ok {
+		h.writeHeaders(id, header)
+	}
+}
+
+// observer can be implemented by a limiter that needs to know how long a
+// request it allowed took to handle and what status code it returned
+type observer interface {
+	observe(id string, elapsed time.Duration, statusCode int)
+}
+
+// statusRecorder wraps a http.ResponseWriter to record the status code and
+// the number of bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (s *statusRecorder) Write(bytes []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(bytes)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	s.statusCode = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func writeBytes(w http.ResponseWriter, logger *logger.Logger, bytes []byte) {
+	if _, err := w.Write(bytes); err != nil {
+		logger.Error("error while writing bytes", "error", err)
+	}
+}
+
+// readBody reads and closes the request body, if the body is larger than
+// the server allows (see http.MaxBytesReader), it responds with 413
+func readBody(w http.ResponseWriter, r *http.Request, logger *logger.Logger) ([]byte, bool) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if maxBytesError := new(http.MaxBytesError); errors.As(err, &maxBytesError) {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		w.WriteHeader(statusCode)
+		writeBytes(w, logger, []byte(err.Error()))
+		return nil, false
+	}
+	return bodyBytes, true
+}
+
+// middleware reads the request from the body, executes the limiter and if
+// the request isn't limited, executes next with the body restored
+func middleware(l Limiter, algorithm LimiterType, options middlewareOptions, next http.HandlerFunc) http.HandlerFunc {
+	logger := options.logger
+	if options.policy == "" {
+		options.policy = Policy(algorithm)
+	}
+	if options.metrics != nil {
+		options.metrics.register(l, algorithm, options.policy)
+	}
+	if options.tracer == nil {
+		options.tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := options.tracer.Start(r.Context(), spanName, trace.WithAttributes(
+			attribute.String(attributeAlgorithm, string(algorithm)),
+			attribute.String(attributePolicy, string(options.policy)),
+		))
+		defer span.End()
+
+		//read the request from bytes
+		request := data.NewRequest()
+		bodyBytes, ok := readBody(w, r, logger)
+		if !ok {
+			return
+		}
+		if err := request.UnmarshalBinary(bodyBytes); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeBytes(w, logger, []byte(err.Error()))
+			return
+		}
+		if !options.validWeight(request.Weight) {
+			w.WriteHeader(http.StatusBadRequest)
+			writeBytes(w, logger, []byte(fmt.Sprintf("weight %d outside of allowed range [%d, %d]",
+				request.Weight, options.weightMin, options.weightMax)))
+			return
+		}
+		cost := options.requestCost(r, request)
+		options.seen.touch(request.ApplicationId)
+		span.SetAttributes(
+			attribute.String(attributeKey, request.ApplicationId),
+			attribute.Int64(attributeCost, cost),
+		)
+
+		//execute the rate limiter, if the cost is charged after the request is
+		// handled, the request is admitted with the declared cost as an
+		// estimate (at least one, so concurrent requests can't all get in
+		// while there's any balance) and the difference is settled afterwards
+		charger, postHoc := l.(Charger)
+		postHoc = postHoc && options.costMode != "" && options.costMode != CostModeDeclared
+		if postHoc {
+			cost = max(cost, 1)
+		}
+		parameters := []any{cost, request.Priority, newReceipt()}
+		tLimit := time.Now()
+		limited := l.Limit(ctx, request.ApplicationId, parameters...)
+		options.metrics.decision(algorithm, options.policy, l, request.ApplicationId, limited)
+		span.SetAttributes(
+			attribute.String(attributeDecision, decision(limited)),
+			attribute.Int64(attributeQueueWait, time.Since(tLimit).Milliseconds()),
+		)
+		if h, ok := l.(headerWriter); ok {
+			h.writeHeaders(request.ApplicationId, w.Header())
+		}
+		if limited {
+			bytes := []byte("too many requests received")
+			if retryAfterer, ok := l.(retryAfterer); ok {
+				retryAfter := retryAfterer.retryAfter(request.ApplicationId)
+				w.Header().Add("Retry-After", fmt.Sprint(int64(math.Ceil(retryAfter.Seconds()))))
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			writeBytes(w, logger, bytes)
+			return
+		}
+
+		//execute next endpoint
+		if releaser, ok := l.(Releaser); ok {
+			defer releaser.Release(request.ApplicationId)
+		}
+		var once sync.Once
+		var refunded atomic.Bool
+		refund := func() {
+			once.Do(func() {
+				refunded.Store(true)
+				if refunder, ok := l.(Refunder); ok {
+					refunder.Refund(request.ApplicationId, parameters...)
+				}
+				logger.Decision("refunded", "id", request.ApplicationId)
+			})
+		}
+		handlerCost := new(atomic.Int64)
+		handlerCost.Store(-1)
+		ctx = context.WithValue(ctx, refundKey{}, refund)
+		ctx = context.WithValue(ctx, costKey{}, handlerCost)
+		//the exclusion is shared with the outer middleware (if chained) since
+		// they observe the same handler
+		excluded, ok := ctx.Value(excludeKey{}).(*atomic.Int64)
+		if !ok {
+			excluded = new(atomic.Int64)
+			ctx = context.WithValue(ctx, excludeKey{}, excluded)
+		}
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		tStart := time.Now()
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		next(recorder, r.WithContext(ctx))
+		elapsed := time.Since(tStart)
+		options.metrics.handled(algorithm, options.policy, request.ApplicationId, elapsed)
+
+		//account for the handled request
+		if observer, ok := l.(observer); ok {
+			latency := max(elapsed-time.Duration(excluded.Load()), 0)
+			observer.observe(request.ApplicationId, latency, recorder.statusCode)
+		}
+		span.SetAttributes(attribute.Int(attributeStatusCode, recorder.statusCode))
+		if options.refundable(recorder.statusCode) {
+			refund()
+		}
+		//a refunded request isn't charged in any cost mode, it's refunded
+		// because it failed on our end (or was cancelled) so the customer
+		// isn't penalized for it, regardless of how long it took
+		if postHoc && !refunded.Load() {
+			charged := options.cost(cost, handlerCost.Load(), elapsed, recorder.bytes)
+			charger.Charge(request.ApplicationId, charged-cost)
+			logger.Decision("charged", "id", request.ApplicationId, "cost", charged, "estimate", cost)
+		}
+	})
+}
+
+type refundKey struct{}
+
+// Refund refunds whatever the limiter consumed for the request associated
+// with ctx (e.g. because it failed downstream or was cancelled), it returns
+// false if the request wasn't admitted by a limiter's middleware; a request
+// is only refunded once
+func Refund(ctx context.Context) bool {
+	refund, ok := ctx.Value(refundKey{}).(func())
+	if !ok {
+		return false
+	}
+	refund()
+	return true
+}
+
+type costKey struct{}
+
+// SetCost sets the cost of the request associated with ctx, it's used when
+// the cost mode is "handler" to charge the request after it's handled; it
+// returns false if the middleware didn't install a cost
+func SetCost(ctx context.Context, cost int64) bool {
+	handlerCost, ok := ctx.Value(costKey{}).(*atomic.Int64)
+	if !ok {
+		return false
+	}
+	handlerCost.Store(cost)
+	return true
+}
+
+type excludeKey struct{}
+
+// Exclude excludes a duration the handler deliberately spent (e.g. waiting
+// as long as the client asked it to) from the latency observed by limiters
+// that adapt to latency; it returns false if the middleware didn't install
+// an exclusion
+func Exclude(ctx context.Context, d time.Duration) bool {
+	excluded, ok := ctx.Value(excludeKey{}).(*atomic.Int64)
+	if !ok {
+		return false
+	}
+	excluded.Add(int64(d))
+	return true
+}
+
+type requestCostKey struct{}
+
+// WithRequestCost returns a copy of ctx with the cost of the request as
+// declared by the server (e.g. by the route), it takes precedence over the
+// weight declared by the client but not over the cost table
+func WithRequestCost(ctx context.Context, cost int64) context.Context {
+	return context.WithValue(ctx, requestCostKey{}, cost)
+}
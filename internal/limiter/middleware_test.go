@@ -0,0 +1,59 @@
+package limiter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+)
+
+// TestPostHocReservesEstimate verifies that in post-hoc mode concurrent
+// requests can't all be admitted while there's any balance left (each
+// reserves an estimate) and that the difference is settled afterwards
+func TestPostHocReservesEstimate(t *testing.T) {
+	const requests = 4
+
+	c := config.NewConfiguration()
+	c.QuotaLimit = 2
+	c.QuotaFile = ""
+	c.CostMode = string(CostModeHandler)
+	l := NewQuota(c)
+	defer l.Stop()
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(requests)
+	handler := l.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		SetCost(r.Context(), 0)
+	})
+	body, _ := (&data.Request{ApplicationId: "id", Weight: 1}).MarshalBinary()
+	statusCodes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+			statusCodes <- w.Code
+		}()
+	}
+	var limited int
+	for i := 0; i < requests-2; i++ {
+		if statusCode := <-statusCodes; statusCode == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	close(release)
+	wg.Wait()
+	if limited != requests-2 {
+		t.Fatalf("expected %d requests to be limited, got %d", requests-2, limited)
+	}
+	//the admitted requests cost nothing, so the estimates are given back
+	if balance := l.(Charger).Balance("id"); balance != 2 {
+		t.Fatalf("expected the estimates to be settled, got a balance of %d", balance)
+	}
+}
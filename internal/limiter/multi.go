@@ -0,0 +1,177 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+)
+
+const multiComponent string = "multi"
+
+// multi chains several limiters (policies) so they can run side by side, a
+// request must be admitted by every limiter in order; this is how a shadow
+// limiter is run next to an enforcing one, shadow limiters are executed
+// first so they see every request, not only those the enforcing limiters
+// admitted
+type multi struct {
+	logger   *logger.Logger
+	limiters []Limiter
+}
+
+func NewMulti(parameters ...any) Limiter {
+	m := &multi{}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			m.logger = p
+		case Limiter:
+			m.limiters = append(m.limiters, p)
+		case []Limiter:
+			m.limiters = append(m.limiters, p...)
+		}
+	}
+	//shadow limiters never limit, so moving them first doesn't change which
+	// requests are admitted
+	slices.SortStableFunc(m.limiters, func(a, b Limiter) int {
+		_, aShadow := a.(*shadow)
+		_, bShadow := b.(*shadow)
+		switch {
+		case aShadow && !bShadow:
+			return -1
+		case bShadow && !aShadow:
+			return 1
+		}
+		return 0
+	})
+	m.logger = m.logger.Component(multiComponent)
+	return m
+}
+
+// undo releases and refunds whatever was consumed by the given limiters for
+// a request that was limited by a later limiter
+func undo(limiters []Limiter, id string, parameters ...any) {
+	for _, l := range limiters {
+		if releaser, ok := l.(Releaser); ok {
+			releaser.Release(id)
+		}
+		if refunder, ok := l.(Refunder); ok {
+			refunder.Refund(id, parameters...)
+		}
+	}
+}
+
+// Limit executes each limiter in order, if one of them limits the request
+// what the previous limiters consumed is undone (a receipt is added to the
+// parameters so it's undone exactly)
+func (m *multi) Limit(ctx context.Context, id string, parameters ...any) bool {
+	parameters = withReceipt(parameters)
+	for i, l := range m.limiters {
+		if l.Limit(ctx, id, parameters...) {
+			undo(m.limiters[:i], id, parameters...)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multi) Wait(ctx context.Context, id string, cost int64) error {
+	for i, l := range m.limiters {
+		if err := l.Wait(ctx, id, cost); err != nil {
+			undo(m.limiters[:i], id, cost)
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multi) Release(id string) {
+	for _, l := range m.limiters {
+		if releaser, ok := l.(Releaser); ok {
+			releaser.Release(id)
+		}
+	}
+}
+
+// Keys returns the keys of every limiter that can be inspected
+func (m *multi) Keys() []string {
+	var keys []string
+
+	seen := make(map[string]struct{})
+	for _, l := range m.limiters {
+		inspector, ok := l.(Inspector)
+		if !ok {
+			continue
+		}
+		for _, id := range inspector.Keys() {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				keys = append(keys, id)
+			}
+		}
+	}
+	return keys
+}
+
+// KeyState returns the state of the given id from the first limiter that
+// can be inspected and has state for it
+func (m *multi) KeyState(id string) *data.KeyState {
+	for _, l := range m.limiters {
+		if inspector, ok := l.(Inspector); ok {
+			if s := inspector.KeyState(id); s != nil {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// Reset resets the given id in every limiter that can be administered
+func (m *multi) Reset(id string) {
+	for _, l := range m.limiters {
+		if administrator, ok := l.(Administrator); ok {
+			administrator.Reset(id)
+		}
+	}
+}
+
+// Grant grants extra capacity to the given id in every limiter that can be
+// administered
+func (m *multi) Grant(id string, tokens int64, duration time.Duration) {
+	for _, l := range m.limiters {
+		if administrator, ok := l.(Administrator); ok {
+			administrator.Grant(id, tokens, duration)
+		}
+	}
+}
+
+// Middleware chains the middleware of each limiter, the first limiter is the
+// outermost so it's executed first
+func (m *multi) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	for i := len(m.limiters) - 1; i >= 0; i-- {
+		next = m.limiters[i].Middleware(next)
+	}
+	return next
+}
+
+// Check returns the first error of the limiters that implement Checker
+func (m *multi) Check(ctx context.Context) error {
+	for _, l := range m.limiters {
+		if checker, ok := l.(Checker); ok {
+			if err := checker.Check(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *multi) Stop() {
+	for i := len(m.limiters) - 1; i >= 0; i-- {
+		m.limiters[i].Stop()
+	}
+	m.logger.Info("stopped")
+}
@@ -0,0 +1,450 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const quotaComponent string = "quota"
+
+const (
+	QuotaPeriodDaily   string = "daily"
+	QuotaPeriodMonthly string = "monthly"
+)
+
+// quotaWarningThresholds are the percentages of the quota used at which the
+// warning header is populated, they're ordered from highest to lowest
+var quotaWarningThresholds = []int64{100, 80}
+
+type quotaCounter struct {
+	Used   int64     `json:"used"`
+	Window time.Time `json:"window"`
+}
+
+type quota struct {
+	sync.RWMutex
+	sync.WaitGroup
+	middlewareOptions
+	config struct {
+		limit           int64
+		period          string
+		location        *time.Location
+		file            string
+		persistInterval time.Duration
+	}
+	stopper  chan struct{}
+	counters map[string]*quotaCounter
+	waiters  map[string]*waiters
+	timers   map[string]*time.Timer
+	dirty    bool
+	saveErr  error
+}
+
+func NewQuota(parameters ...any) Limiter {
+	q := &quota{
+		middlewareOptions: newMiddlewareOptions(),
+		counters:          make(map[string]*quotaCounter),
+		waiters:           make(map[string]*waiters),
+		timers:            make(map[string]*time.Timer),
+		stopper:           make(chan struct{}),
+	}
+	timezone := config.DefaultQuotaTimezone
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			q.logger = p
+		case *Metrics:
+			q.metrics = p
+		case Policy:
+			q.policy = p
+		case trace.TracerProvider:
+			q.tracer = p.Tracer(tracerName)
+		case *config.Configuration:
+			q.fromConfig(p)
+			q.config.limit = p.QuotaLimit
+			q.config.period = p.QuotaPeriod
+			q.config.file = p.QuotaFile
+			q.config.persistInterval = p.QuotaPersistInterval
+			timezone = p.QuotaTimezone
+		}
+	}
+	q.logger = q.logger.Component(quotaComponent)
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		q.logger.Warn("unable to load timezone, using UTC", "timezone", timezone, "error", err)
+		location = time.UTC
+	}
+	q.config.location = location
+	if err := q.load(); err != nil {
+		q.logger.Error("unable to load counters", "error", err)
+	}
+	if q.config.file != "" && q.config.persistInterval > 0 {
+		q.launchPersist()
+	}
+	return q
+}
+
+// windowStart returns the start of the calendar window (in the configured
+// timezone) that contains t
+func (q *quota) windowStart(t time.Time) time.Time {
+	t = t.In(q.config.location)
+	switch q.config.period {
+	case QuotaPeriodDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.config.location)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, q.config.location)
+	}
+}
+
+// windowEnd returns the start of the calendar window following the window
+// that starts at start
+func (q *quota) windowEnd(start time.Time) time.Time {
+	switch q.config.period {
+	case QuotaPeriodDaily:
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// counter returns the counter for the given id, resetting it if its window
+// has elapsed; the caller is expected to hold the write lock
+func (q *quota) counter(id string, now time.Time) *quotaCounter {
+	window := q.windowStart(now)
+	c, ok := q.counters[id]
+	if !ok {
+		c = &quotaCounter{Window: window}
+		q.counters[id] = c
+	}
+	if !c.Window.Equal(window) {
+		c.Used, c.Window = 0, window
+		q.dirty = true
+	}
+	return c
+}
+
+// used returns how much of the quota the given id has used in the window
+// that contains now without creating a counter, ids without a counter (or
+// whose window has elapsed) haven't used any; the caller is expected to hold
+// the lock
+func (q *quota) used(id string, now time.Time) (int64, time.Time) {
+	window := q.windowStart(now)
+	c, ok := q.counters[id]
+	if !ok || !c.Window.Equal(window) {
+		return 0, window
+	}
+	return c.Used, window
+}
+
+func (q *quota) load() error {
+	if q.config.file == "" {
+		return nil
+	}
+	bytes, err := os.ReadFile(q.config.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	counters := make(map[string]*quotaCounter)
+	if err := json.Unmarshal(bytes, &counters); err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.counters = counters
+	return nil
+}
+
+func (q *quota) save() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.config.file == "" || !q.dirty {
+		return nil
+	}
+	bytes, err := json.Marshal(q.counters)
+	if err != nil {
+		return err
+	}
+	tmp := q.config.file + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.config.file); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *quota) launchPersist() {
+	q.Add(1)
+	started := make(chan struct{})
+	go func() {
+		defer q.Done()
+
+		tPersist := time.NewTicker(q.config.persistInterval)
+		defer tPersist.Stop()
+		close(started)
+		for {
+			select {
+			case <-q.stopper:
+				return
+			case <-tPersist.C:
+				err := q.save()
+				q.Lock()
+				q.saveErr = err
+				q.Unlock()
+				if err != nil {
+					q.logger.Error("unable to save counters", "error", err)
+				}
+			}
+		}
+	}()
+	<-started
+}
+
+func (q *quota) Limit(ctx context.Context, id string, parameters ...any) bool {
+	var cost int64 = 1
+
+	for _, parameter := range parameters {
+		if i, ok := parameter.(int64); ok {
+			cost = max(i, 1) //a cost that isn't positive would credit the quota
+		}
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	c := q.counter(id, time.Now())
+	if !q.consume(c, cost) {
+		q.logger.Decision("limited", "id", id, "used", c.Used, "limit", q.config.limit)
+		return true
+	}
+	q.logger.Decision("allowed", "id", id, "used", c.Used, "limit", q.config.limit)
+	return false
+}
+
+func (q *quota) Balance(id string) int64 {
+	q.RLock()
+	defer q.RUnlock()
+
+	used, _ := q.used(id, time.Now())
+	return q.config.limit - used
+}
+
+func (q *quota) Charge(id string, cost int64) {
+	q.Lock()
+	defer q.Unlock()
+
+	c := q.counter(id, time.Now())
+	c.Used = max(c.Used+cost, 0)
+	q.dirty = true
+}
+
+func (q *quota) Refund(id string, parameters ...any) {
+	var cost int64 = 1
+
+	for _, parameter := range parameters {
+		if i, ok := parameter.(int64); ok {
+			cost = max(i, 0) //negative costs would consume the quota
+		}
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	c := q.counter(id, time.Now())
+	c.Used = max(c.Used-cost, 0)
+	q.dirty = true
+}
+
+// Wait blocks until the cost fits within the quota, if it doesn't fit in the
+// current window, waiters are admitted (in FIFO order) once the window resets
+func (q *quota) Wait(ctx context.Context, id string, cost int64) error {
+	cost = max(cost, 1) //a cost that isn't positive would credit the quota
+	if cost > q.config.limit {
+		return ErrCostExceedsCapacity
+	}
+	q.Lock()
+	c := q.counter(id, time.Now())
+	w, ok := q.waiters[id]
+	if !ok {
+		w = &waiters{}
+		q.waiters[id] = w
+	}
+	if w.len() == 0 && q.consume(c, cost) {
+		q.Unlock()
+		return nil
+	}
+	q.scheduleAdmit(id, c)
+	element := w.push(cost)
+	q.Unlock()
+	q.logger.Decision("waiting for reset", "id", id, "cost", cost)
+	return wait(ctx, q, w, element, func() {
+		q.Lock()
+		defer q.Unlock()
+		c := q.counter(id, time.Now())
+		c.Used = max(c.Used-cost, 0)
+		q.dirty = true
+	})
+}
+
+// consume adds the cost to the counter if it fits within the quota, the
+// caller is expected to hold the lock
+func (q *quota) consume(c *quotaCounter, cost int64) bool {
+	if c.Used+cost > q.config.limit {
+		return false
+	}
+	c.Used += cost
+	q.dirty = true
+	return true
+}
+
+// admit is executed when a window resets, admitting the waiters for the
+// given id that fit within the new window
+func (q *quota) admit(id string) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.timers, id)
+	select {
+	case <-q.stopper:
+		return
+	default:
+	}
+	c, w := q.counter(id, time.Now()), q.waiters[id]
+	w.admit(func(cost int64) bool { return q.consume(c, cost) })
+	if w.len() > 0 {
+		q.scheduleAdmit(id, c)
+	}
+}
+
+// scheduleAdmit admits the waiters for the given id once the window of the
+// counter resets (if it isn't already scheduled), the timers are stopped by
+// Stop; the caller is expected to hold the lock
+func (q *quota) scheduleAdmit(id string, c *quotaCounter) {
+	if _, ok := q.timers[id]; ok {
+		return
+	}
+	q.timers[id] = time.AfterFunc(time.Until(q.windowEnd(c.Window)), func() { q.admit(id) })
+}
+
+// Quota returns the quota of the given id, ids that don't have a counter
+// are reported as not having used any of it (a counter isn't created, so
+// querying arbitrary ids doesn't use any memory)
+func (q *quota) Quota(id string) *data.Quota {
+	q.RLock()
+	defer q.RUnlock()
+
+	used, window := q.used(id, time.Now())
+	remaining := q.config.limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &data.Quota{
+		ApplicationId: id,
+		Period:        q.config.period,
+		Limit:         q.config.limit,
+		Used:          used,
+		Remaining:     remaining,
+		Reset:         q.windowEnd(window),
+	}
+}
+
+func (q *quota) writeHeaders(id string, header http.Header) {
+	quota := q.Quota(id)
+	header.Set(data.HeaderQuotaLimit, fmt.Sprint(quota.Limit))
+	header.Set(data.HeaderQuotaRemaining, fmt.Sprint(quota.Remaining))
+	header.Set(data.HeaderQuotaReset, fmt.Sprint(quota.Reset.Unix()))
+	for _, threshold := range quotaWarningThresholds {
+		if quota.Used*100 >= threshold*quota.Limit {
+			header.Set(data.HeaderQuotaWarning, fmt.Sprintf("%d%%", threshold))
+			break
+		}
+	}
+}
+
+func (q *quota) retryAfter(id string) time.Duration {
+	return time.Until(q.Quota(id).Reset)
+}
+
+func (q *quota) Keys() []string {
+	q.RLock()
+	defer q.RUnlock()
+
+	keys := make([]string, 0, len(q.counters))
+	for id := range q.counters {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// KeyState returns the quota remaining for the given id
+func (q *quota) KeyState(id string) *data.KeyState {
+	q.RLock()
+	defer q.RUnlock()
+
+	c, ok := q.counters[id]
+	if !ok {
+		return nil
+	}
+	s := &data.KeyState{
+		Key:      id,
+		Tokens:   q.config.limit - c.Used,
+		LastSeen: q.seen.load(id),
+	}
+	if q.config.limit > 0 {
+		s.Fill = float64(max(s.Tokens, 0)) / float64(q.config.limit)
+	}
+	if w, ok := q.waiters[id]; ok {
+		s.QueueLength = w.len()
+	}
+	return s
+}
+
+func (q *quota) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(q, LimiterTypeQuota, q.middlewareOptions, next)
+}
+
+// Check returns an error if the quota has been stopped or the counters
+// couldn't be saved the last time they were persisted
+func (q *quota) Check(ctx context.Context) error {
+	if err := checkStopper(q.stopper); err != nil {
+		return err
+	}
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.saveErr != nil {
+		return errors.Wrap(q.saveErr, "unable to save counters")
+	}
+	return nil
+}
+
+func (q *quota) Stop() {
+	close(q.stopper)
+	q.Lock()
+	for id, timer := range q.timers {
+		timer.Stop()
+		delete(q.timers, id)
+	}
+	q.Unlock()
+	q.WaitGroup.Wait()
+	if err := q.save(); err != nil {
+		q.logger.Error("unable to save counters", "error", err)
+	}
+	q.logger.Info("stopped")
+}
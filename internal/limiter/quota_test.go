@@ -0,0 +1,32 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestQuotaNonPositiveCost verifies that costs that aren't positive neither
+// credit the quota when they're limited nor consume it when they're refunded
+func TestQuotaNonPositiveCost(t *testing.T) {
+	c := config.NewConfiguration()
+	c.QuotaLimit = 2
+	l := NewQuota(c).(*quota)
+	defer l.Stop()
+	ctx := context.Background()
+
+	for i := range 2 {
+		if l.Limit(ctx, "id", int64(-5)) {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+	if !l.Limit(ctx, "id", int64(-5)) {
+		t.Fatal("expected a negative cost to count as one rather than credit the quota")
+	}
+	l.Refund("id", int64(1))
+	l.Refund("id", int64(-5))
+	if v := l.Balance("id"); v != 1 {
+		t.Fatalf("expected a negative refund to be ignored, got a balance of %d", v)
+	}
+}
@@ -0,0 +1,60 @@
+package limiter
+
+import "sync"
+
+// receipt records what limiters consumed for a request (e.g. what each
+// bucket of a hierarchy was charged) so it can be refunded exactly; the
+// middleware provides one along with the parameters given to Limit and
+// Refund, limiters that don't need it ignore it
+type receipt struct {
+	sync.Mutex
+	charges map[Limiter]map[string]int64
+}
+
+func newReceipt() *receipt {
+	return &receipt{charges: make(map[Limiter]map[string]int64)}
+}
+
+// findReceipt returns the receipt in the parameters, if any
+func findReceipt(parameters ...any) *receipt {
+	for _, parameter := range parameters {
+		if r, ok := parameter.(*receipt); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// withReceipt returns the parameters with a receipt, one is added if there
+// isn't one already
+func withReceipt(parameters []any) []any {
+	if findReceipt(parameters...) != nil {
+		return parameters
+	}
+	return append(parameters[:len(parameters):len(parameters)], newReceipt())
+}
+
+// record records the charges of the limiter, the receipt can be nil
+func (r *receipt) record(l Limiter, charges map[string]int64) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	r.charges[l] = charges
+}
+
+// take returns (and removes) the charges recorded for the limiter, so they
+// can only be refunded once
+func (r *receipt) take(l Limiter) (map[string]int64, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	charges, ok := r.charges[l]
+	delete(r.charges, l)
+	return charges, ok
+}
@@ -0,0 +1,134 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reserver can be implemented by a limiter to reserve capacity ahead of time
+// instead of being told yes or no; this is useful for background jobs that
+// can schedule their work in-process rather than polling (similar to
+// golang.org/x/time/rate)
+type Reserver interface {
+	Reserve(ctx context.Context, id string, cost int64) *Reservation
+}
+
+// Reservation holds the capacity reserved by a limiter for a request, the
+// request can proceed once Delay has elapsed or the reservation can be
+// cancelled to refund the capacity that hasn't been used
+type Reservation struct {
+	once   sync.Once
+	ok     bool
+	tAct   time.Time
+	cancel func()
+}
+
+func newReservation(delay time.Duration, cancel func()) *Reservation {
+	return &Reservation{
+		ok:     true,
+		tAct:   time.Now().Add(delay),
+		cancel: cancel,
+	}
+}
+
+// OK returns whether the limiter can provide the requested cost, if false
+// the cost is larger than the limiter's capacity and Delay is meaningless
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long to wait before the request may proceed, zero means
+// the request may proceed immediately
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return 0
+	}
+	if delay := time.Until(r.tAct); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Cancel refunds the reserved capacity that hasn't been used to the limiter,
+// once the delay has elapsed the capacity is considered used and nothing is
+// refunded (as with golang.org/x/time/rate); it's safe to call more than once
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil || !time.Now().Before(r.tAct) {
+		return
+	}
+	r.once.Do(r.cancel)
+}
+
+// unused returns how many of the tokens of a reservation can be refunded:
+// the tokens that later reservations have relied upon (their delay was
+// computed as if this reservation's tokens were taken) aren't refunded;
+// reserved is the running total of tokens reserved for the bucket and
+// reservedAt is what it was once this reservation was made
+func unused(cost, reservedAt, reserved int64) int64 {
+	return max(cost-(reserved-reservedAt), 0)
+}
+
+// refill adds tokens to the bucket without exceeding its capacity; tokens
+// that are owed (a negative balance) are carried over rather than forgiven
+// and tokens already above the capacity (e.g. granted) aren't removed
+func refill(i *atomic.Int64, tokens, capacity int64) {
+	for {
+		v := i.Load()
+		if i.CompareAndSwap(v, max(min(v+tokens, capacity), v)) {
+			return
+		}
+	}
+}
+
+// owe returns how many of the tokens of a reservation the bucket didn't have
+// when it was made, given the tokens left in the bucket afterwards
+func owe(cost, tokens int64) int64 {
+	return min(cost, max(-tokens, 0))
+}
+
+// replenish restores the bucket to its capacity, if debt is carried, what's
+// owed (a negative balance) is paid back first; otherwise only the tokens
+// owed to reservations are paid back (they were promised to a request) and
+// any other debt (e.g. from a post-hoc charge) is forgiven. Tokens already
+// above the capacity (e.g. granted) are only kept if debt is carried. It
+// returns what's still owed to reservations afterwards
+func replenish(i *atomic.Int64, capacity, owed int64, carryDebt bool) int64 {
+	if !carryDebt {
+		i.Store(capacity - owed)
+		return max(owed-capacity, 0)
+	}
+	refill(i, capacity, capacity)
+	return 0
+}
+
+// take removes the given number of tokens from the bucket if it has at least
+// that many, it returns false (and removes nothing) otherwise; a cost that
+// isn't positive is never taken since it would add tokens
+func take(i *atomic.Int64, tokens int64) bool {
+	if tokens <= 0 {
+		return false
+	}
+	for {
+		v := i.Load()
+		if v < tokens {
+			return false
+		}
+		if i.CompareAndSwap(v, v-tokens) {
+			return true
+		}
+	}
+}
+
+// reservationDelay returns how long a reservation has to wait given what the
+// bucket owes once it was made: the reservation has to wait for enough
+// replenishments to cover what's owed, so reservations past the capacity are
+// staggered an interval apart
+func reservationDelay(owed, capacity int64, interval time.Duration, tReplinished time.Time) time.Duration {
+	if owed <= 0 {
+		return 0
+	}
+	replenishments := (owed + capacity - 1) / capacity
+	return time.Until(tReplinished.Add(interval)) + time.Duration(replenishments-1)*interval
+}
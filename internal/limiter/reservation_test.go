@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestReservationCancel verifies that cancelling a reservation only returns
+// the tokens later reservations didn't rely upon and that non-positive costs
+// never add tokens to the bucket
+func TestReservationCancel(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	l := NewToken(c).(*tokenBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	for _, cost := range []int64{0, -3} {
+		if r := l.Reserve(ctx, "id", cost); !r.OK() || r.Delay() != 0 {
+			t.Fatalf("expected a cost of %d to be reserved immediately", cost)
+		}
+	}
+	if v := l.readBucket("id").Load(); v != 2 {
+		t.Fatalf("expected non-positive costs to take one token each, got %d tokens", v)
+	}
+	first := l.Reserve(ctx, "id", 3)
+	second := l.Reserve(ctx, "id", 2)
+	if first.Delay() == 0 || second.Delay() == 0 {
+		t.Fatal("expected reservations past the capacity to be delayed")
+	}
+	//the second reservation relied on two of the first one's tokens, so
+	// only one of them can be returned
+	first.Cancel()
+	if v := l.readBucket("id").Load(); v != -2 {
+		t.Fatalf("expected cancel to return 1 token, got %d tokens", v)
+	}
+	second.Cancel()
+	second.Cancel()
+	if v := l.readBucket("id").Load(); v != 0 {
+		t.Fatalf("expected cancel to return 2 tokens once, got %d tokens", v)
+	}
+}
+
+// TestReservationStaggered verifies that with CARRY_DEBT unset, reservations
+// past the capacity are staggered an interval apart and that replenishing
+// pays back what's owed to them rather than forgiving it
+func TestReservationStaggered(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	c.CarryDebt = false
+	l := NewToken(c).(*tokenBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	var delays []time.Duration
+	for i := 0; i < 3; i++ {
+		r := l.Reserve(ctx, "id", c.Maxtokens)
+		if !r.OK() {
+			t.Fatalf("expected reservation %d to be ok", i)
+		}
+		delays = append(delays, r.Delay())
+	}
+	if delays[0] != 0 {
+		t.Fatalf("expected the first reservation not to be delayed, got %v", delays[0])
+	}
+	for i, expected := range []time.Duration{c.TokenReplinish, 2 * c.TokenReplinish} {
+		if delay := delays[i+1]; delay <= expected-time.Minute || delay > expected {
+			t.Fatalf("expected reservation %d to be delayed by about %v, got %v", i+1, expected, delay)
+		}
+	}
+	//each replenishment pays for one of the reservations
+	for _, expected := range []int64{-4, 0, 4} {
+		l.replinish()
+		if v := l.Balance("id"); v != expected {
+			t.Fatalf("expected %d tokens after replenishing, got %d", expected, v)
+		}
+	}
+}
+
+// TestReservationForgivesChargedDebt verifies that with CARRY_DEBT unset,
+// debt that isn't owed to a reservation (e.g. a post-hoc charge) is still
+// forgiven when the bucket is replenished
+func TestReservationForgivesChargedDebt(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	l := NewToken(c).(*tokenBucket)
+	defer l.Stop()
+
+	l.Charge("id", 6)
+	r := l.Reserve(context.Background(), "id", 2)
+	if r.Delay() == 0 {
+		t.Fatal("expected the reservation to be delayed")
+	}
+	l.replinish()
+	if v := l.Balance("id"); v != 2 {
+		t.Fatalf("expected the charge to be forgiven and the reservation paid for, got %d tokens", v)
+	}
+}
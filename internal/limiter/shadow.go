@@ -0,0 +1,146 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+)
+
+const shadowComponent string = "shadow"
+
+// shadow wraps a limiter to run it in dry-run mode: the limiter is executed
+// for every request and its would-be rejections are counted and logged, but
+// the request is always let through
+type shadow struct {
+	logger   *logger.Logger
+	limiter  Limiter
+	name     LimiterType
+	allowed  atomic.Int64
+	rejected atomic.Int64
+}
+
+func NewShadow(parameters ...any) Limiter {
+	s := &shadow{}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			s.logger = p
+		case Limiter:
+			s.limiter = p
+		case LimiterType:
+			s.name = p
+		}
+	}
+	s.logger = s.logger.Component(shadowComponent)
+	return s
+}
+
+func (s *shadow) record(id string, rejected bool, reason string) {
+	if !rejected {
+		s.logger.Decision("would be allowed", "policy", s.name, "id", id,
+			"allowed", s.allowed.Add(1), "rejected", s.rejected.Load())
+		return
+	}
+	s.logger.Decision("would be rejected", "policy", s.name, "id", id, "reason", reason,
+		"allowed", s.allowed.Load(), "rejected", s.rejected.Add(1))
+}
+
+// Limit executes the wrapped limiter and records its decision, but never
+// limits; anything held by the wrapped limiter is released immediately
+func (s *shadow) Limit(ctx context.Context, id string, parameters ...any) bool {
+	limited := s.limiter.Limit(ctx, id, parameters...)
+	if releaser, ok := s.limiter.(Releaser); ok && !limited {
+		releaser.Release(id)
+	}
+	s.record(id, limited, "limited")
+	return false
+}
+
+// Wait never blocks, a shadow limiter can't delay a request
+func (s *shadow) Wait(ctx context.Context, id string, cost int64) error {
+	return nil
+}
+
+// shadowWriter discards everything written by the wrapped limiter's
+// middleware until it executes next, once admitted, writes are forwarded
+type shadowWriter struct {
+	http.ResponseWriter
+	header     http.Header
+	admitted   bool
+	statusCode int
+}
+
+func (s *shadowWriter) Header() http.Header {
+	if s.admitted {
+		return s.ResponseWriter.Header()
+	}
+	return s.header
+}
+
+func (s *shadowWriter) Write(bytes []byte) (int, error) {
+	if s.admitted {
+		return s.ResponseWriter.Write(bytes)
+	}
+	return len(bytes), nil
+}
+
+func (s *shadowWriter) WriteHeader(statusCode int) {
+	if s.admitted {
+		s.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	s.statusCode = statusCode
+}
+
+// Middleware executes the middleware of the wrapped limiter, if it doesn't
+// execute next (e.g. it responded with 429), the would-be rejection is
+// recorded and next is executed anyway; only a 429 is a rejection, any other
+// response (e.g. a 400 for an invalid weight) isn't counted either way
+func (s *shadow) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, ok := readBody(w, r, s.logger)
+		if !ok {
+			return
+		}
+		request := data.NewRequest()
+		_ = request.UnmarshalBinary(bodyBytes)
+		writer := &shadowWriter{ResponseWriter: w, header: make(http.Header)}
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		s.limiter.Middleware(func(w http.ResponseWriter, r *http.Request) {
+			writer.admitted = true
+			next(w, r)
+		})(writer, r)
+		switch {
+		case writer.admitted:
+			s.record(request.ApplicationId, false, "")
+			return
+		case writer.statusCode == http.StatusTooManyRequests:
+			s.record(request.ApplicationId, true, fmt.Sprintf("status code %d", writer.statusCode))
+		default:
+			s.logger.Debug("not evaluated", "policy", s.name, "id", request.ApplicationId,
+				"status_code", writer.statusCode)
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		next(w, r)
+	}
+}
+
+// Check checks the wrapped limiter, a shadow policy that isn't operational
+// isn't recording anything
+func (s *shadow) Check(ctx context.Context) error {
+	if checker, ok := s.limiter.(Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+func (s *shadow) Stop() {
+	s.limiter.Stop()
+	s.logger.Info("stopped", "policy", s.name, "allowed", s.allowed.Load(), "rejected", s.rejected.Load())
+}
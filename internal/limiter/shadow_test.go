@@ -0,0 +1,46 @@
+package limiter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+)
+
+// TestShadowSeesEveryRequest verifies that a shadow policy chained after an
+// enforcing one still evaluates the requests the enforcing policy rejects
+// and that only a 429 is counted as a would-be rejection
+func TestShadowSeesEveryRequest(t *testing.T) {
+	enforcing := config.NewConfiguration()
+	enforcing.Maxtokens = 1
+	enforcing.TokenReplinish = time.Hour
+	shadowed := config.NewConfiguration()
+	shadowed.Maxtokens = 2
+	shadowed.TokenReplinish = time.Hour
+	s := NewShadow(NewToken(shadowed), LimiterTypeToken).(*shadow)
+	l := NewMulti(NewToken(enforcing), s)
+	defer l.Stop()
+
+	handler := l.Middleware(func(w http.ResponseWriter, r *http.Request) {})
+	send := func(weight int64) int {
+		body, _ := (&data.Request{ApplicationId: "id", Weight: weight}).MarshalBinary()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		return w.Code
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if statusCode := send(1); statusCode != expected {
+			t.Fatalf("expected request %d to get %d, got %d", i, expected, statusCode)
+		}
+	}
+	if statusCode := send(0); statusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid weight to get %d, got %d", http.StatusBadRequest, statusCode)
+	}
+	if allowed, rejected := s.allowed.Load(), s.rejected.Load(); allowed != 2 || rejected != 1 {
+		t.Fatalf("expected the shadow to allow 2 and reject 1, got %d and %d", allowed, rejected)
+	}
+}
@@ -0,0 +1,130 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const sheddingComponent string = "shedding"
+
+// shedding is a load shedding limiter, each priority class has an admission
+// budget (a percentage of the maximum number of requests in flight); as the
+// server becomes saturated the budgets of the lower classes are exhausted
+// first, so their requests are shed before those of the higher classes
+type shedding struct {
+	sync.Mutex
+	middlewareOptions
+	config struct {
+		maxInFlight int
+		budgets     []int
+	}
+	inFlight int
+	waiters  waiters
+}
+
+func NewShedding(parameters ...any) Limiter {
+	s := &shedding{
+		middlewareOptions: newMiddlewareOptions(),
+	}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			s.logger = p
+		case *Metrics:
+			s.metrics = p
+		case Policy:
+			s.policy = p
+		case trace.TracerProvider:
+			s.tracer = p.Tracer(tracerName)
+		case *config.Configuration:
+			s.fromConfig(p)
+			s.config.maxInFlight = p.SheddingMaxInFlight
+			s.config.budgets = p.SheddingBudgets
+		}
+	}
+	s.logger = s.logger.Component(sheddingComponent)
+	return s
+}
+
+// budget returns the maximum number of requests that can be in flight when
+// admitting a request of the given priority, priorities outside of the
+// configured budgets are clamped to the lowest or highest class
+func (s *shedding) budget(priority data.Priority) int {
+	if len(s.config.budgets) == 0 {
+		return s.config.maxInFlight
+	}
+	i := int(priority)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.config.budgets) {
+		i = len(s.config.budgets) - 1
+	}
+	return s.config.maxInFlight * s.config.budgets[i] / 100
+}
+
+func (s *shedding) Limit(ctx context.Context, id string, parameters ...any) bool {
+	var priority data.Priority
+
+	for _, parameter := range parameters {
+		if p, ok := parameter.(data.Priority); ok {
+			priority = p
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if budget := s.budget(priority); s.inFlight >= budget {
+		s.logger.Decision("shed", "id", id, "priority", priority, "in_flight", s.inFlight, "budget", budget)
+		return true
+	}
+	s.inFlight++
+	s.logger.Decision("allowed", "id", id, "priority", priority, "in_flight", s.inFlight, "max_in_flight", s.config.maxInFlight)
+	return false
+}
+
+// Wait blocks until a request can be admitted within the budget of the
+// normal priority class
+func (s *shedding) Wait(ctx context.Context, id string, cost int64) error {
+	s.Lock()
+	if s.waiters.len() == 0 && s.admit(cost) {
+		s.Unlock()
+		return nil
+	}
+	element := s.waiters.push(cost)
+	s.Unlock()
+	return wait(ctx, s, &s.waiters, element, func() { s.Release(id) })
+}
+
+// admit admits a waiter if there's room in the normal priority budget, the
+// caller is expected to hold the lock
+func (s *shedding) admit(int64) bool {
+	if s.inFlight >= s.budget(data.PriorityNormal) {
+		return false
+	}
+	s.inFlight++
+	return true
+}
+
+func (s *shedding) Release(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.inFlight--
+	s.waiters.admit(s.admit)
+}
+
+func (s *shedding) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(s, LimiterTypeShedding, s.middlewareOptions, next)
+}
+
+func (s *shedding) Stop() {
+	s.logger.Info("stopped")
+}
@@ -0,0 +1,77 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestTokenLimitCost verifies that the token bucket takes the cost of the
+// request and that a refund returns exactly what was taken
+func TestTokenLimitCost(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	l := NewToken(c).(*tokenBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	r := newReceipt()
+	if l.Limit(ctx, "id", int64(3), r) {
+		t.Fatal("expected a cost of 3 to be allowed")
+	}
+	if !l.Limit(ctx, "id", int64(2)) {
+		t.Fatal("expected a cost of 2 to be limited with 1 token left")
+	}
+	l.Refund("id", int64(3), r)
+	if v := l.Balance("id"); v != 4 {
+		t.Fatalf("expected the refund to return 3 tokens, got %d tokens", v)
+	}
+}
+
+// TestTokenCheckStalled verifies that Check fails if the bucket hasn't been
+// replenished for a few intervals even though it wasn't stopped
+func TestTokenCheckStalled(t *testing.T) {
+	c := config.NewConfiguration()
+	c.TokenReplinish = time.Minute
+	l := NewToken(c).(*tokenBucket)
+	defer l.Stop()
+
+	if err := l.Check(context.Background()); err != nil {
+		t.Fatalf("expected a running bucket to be healthy, got %v", err)
+	}
+	//pretend the replenish goroutine died a while ago
+	l.replinished.Store(time.Now().Add(-stalledIntervals * 2 * c.TokenReplinish).UnixNano())
+	if err := l.Check(context.Background()); !errors.Is(err, ErrStalled) {
+		t.Fatalf("expected %v, got %v", ErrStalled, err)
+	}
+}
+
+// TestTokenRefundGranted verifies that refunds and negative charges fill the
+// bucket up to its capacity including any grant rather than MAX_TOKENS
+func TestTokenRefundGranted(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	l := NewToken(c).(*tokenBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	l.Grant("id", 4, time.Hour)
+	r := newReceipt()
+	if l.Limit(ctx, "id", int64(6), r) {
+		t.Fatal("expected a cost of 6 to be allowed with the grant")
+	}
+	l.Refund("id", int64(6), r)
+	if v := l.Balance("id"); v != 8 {
+		t.Fatalf("expected the refund to fill the granted capacity, got %d tokens", v)
+	}
+	l.Charge("id", 6)
+	l.Charge("id", -10)
+	if v := l.Balance("id"); v != 8 {
+		t.Fatalf("expected a negative charge to fill the granted capacity, got %d tokens", v)
+	}
+}
@@ -0,0 +1,18 @@
+package limiter
+
+// tracerName is the name of the tracer (the instrumentation scope) used by
+// the middleware
+const tracerName string = "github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+
+// spanName is the name of the span that carries the limiter decision
+const spanName string = "rate_limiter"
+
+const (
+	attributeAlgorithm  string = "rate_limiter.algorithm"
+	attributePolicy     string = "rate_limiter.policy"
+	attributeKey        string = "rate_limiter.key"
+	attributeCost       string = "rate_limiter.cost"
+	attributeDecision   string = "rate_limiter.decision"
+	attributeQueueWait  string = "rate_limiter.queue_wait_ms"
+	attributeStatusCode string = "http.response.status_code"
+)
@@ -0,0 +1,50 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/tracing"
+)
+
+// TestTracingSpan verifies that the middleware records a span with the
+// limiter's decision using the in-memory exporter
+func TestTracingSpan(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 1
+	c.TokenReplinish = time.Hour
+	c.TracingExporter = tracing.ExporterMemory
+	tr, err := tracing.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Shutdown(context.Background())
+	l := NewToken(c, tr.TracerProvider)
+	defer l.Stop()
+
+	handler := l.Middleware(func(w http.ResponseWriter, r *http.Request) {})
+	body, _ := (&data.Request{ApplicationId: "id", Weight: 1}).MarshalBinary()
+	for i := 0; i < 2; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	}
+	var decisions []string
+	for _, span := range tr.Ended() {
+		if span.Name() != spanName {
+			continue
+		}
+		for _, attribute := range span.Attributes() {
+			if string(attribute.Key) == attributeDecision {
+				decisions = append(decisions, attribute.Value.AsString())
+			}
+		}
+	}
+	if len(decisions) != 2 || decisions[0] != decisionAllowed || decisions[1] != decisionDenied {
+		t.Fatalf("expected an allowed and a denied span, got %v", decisions)
+	}
+}
@@ -3,18 +3,105 @@ package limiter
 import (
 	"context"
 	"net/http"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+
+	"github.com/pkg/errors"
 )
 
+// ErrCostExceedsCapacity is returned by Wait if the cost can never be
+// admitted because it's larger than the limiter's capacity
+var ErrCostExceedsCapacity = errors.New("cost exceeds capacity")
+
+// ErrQueueFull is returned by Wait if the request can't be queued because
+// the limiter's queue is full
+var ErrQueueFull = errors.New("queue full")
+
+// ErrStopped is returned by Check once the limiter has been stopped
+var ErrStopped = errors.New("limiter stopped")
+
+// ErrStalled is returned by Check if the goroutine that replenishes (or
+// drains) the limiter isn't running even though it hasn't been stopped
+var ErrStalled = errors.New("limiter stalled")
+
 type LimiterType string
 
 const (
-	LimiterTypeLeaky    LimiterType = "leaky"
-	LimiterTypeToken    LimiterType = "token"
-	LimiterTypeWeighted LimiterType = "token_weighted"
+	LimiterTypeLeaky        LimiterType = "leaky"
+	LimiterTypeToken        LimiterType = "token"
+	LimiterTypeWeighted     LimiterType = "token_weighted"
+	LimiterTypeQuota        LimiterType = "quota"
+	LimiterTypeConcurrency  LimiterType = "concurrency"
+	LimiterTypeAdaptive     LimiterType = "adaptive"
+	LimiterTypeShedding     LimiterType = "shedding"
+	LimiterTypeFair         LimiterType = "fair"
+	LimiterTypeHierarchical LimiterType = "hierarchical"
+)
+
+const (
+	CostModeDeclared string = "declared"
+	CostModeDuration string = "duration"
+	CostModeBytes    string = "bytes"
+	CostModeHandler  string = "handler"
 )
 
 type Limiter interface {
 	Limit(ctx context.Context, id string, parameters ...any) bool
+	// Wait blocks until a request with the given cost is admitted (waiters
+	// are admitted in FIFO order) or ctx is done
+	Wait(ctx context.Context, id string, cost int64) error
 	Stop()
 	Middleware(http.HandlerFunc) http.HandlerFunc
 }
+
+// Releaser is implemented by limiters that hold capacity for as long as a
+// request is in flight (e.g. a concurrency slot), Release must be called
+// once a request that was allowed by Limit (or admitted by Wait) is done;
+// the Middleware does this once the handler returns
+type Releaser interface {
+	Release(id string)
+}
+
+// Inspector can be implemented by a limiter that keeps state per key, the
+// state of a key that doesn't exist is nil
+type Inspector interface {
+	Keys() []string
+	KeyState(id string) *data.KeyState
+}
+
+// Administrator can be implemented by a limiter whose keys can be reset (to
+// their initial state) or granted temporary extra capacity
+type Administrator interface {
+	Reset(id string)
+	Grant(id string, tokens int64, duration time.Duration)
+}
+
+// Checker can be implemented by a limiter that depends on background
+// goroutines (e.g. to replenish tokens) or a shared store, Check returns an
+// error if the limiter isn't operational
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// QuotaReader can be implemented by limiters that track long-horizon quotas
+// to allow the remaining quota for a given id to be queried
+type QuotaReader interface {
+	Quota(id string) *data.Quota
+}
+
+// Refunder can be implemented by limiters that consume capacity (e.g. tokens)
+// to give it back, the parameters are the same as those given to Limit
+type Refunder interface {
+	Refund(id string, parameters ...any)
+}
+
+// Charger can be implemented by limiters to charge the cost of a request
+// after it's been handled (instead of trusting the declared weight); the
+// request is admitted by Limit with an estimate of its cost and once it's
+// been handled the difference is charged (a negative cost gives back what
+// was overestimated), the charge can overdraw the balance
+type Charger interface {
+	Balance(id string) int64
+	Charge(id string, cost int64)
+}
@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+type waiter struct {
+	cost     int64
+	charges  map[string]int64 //what was consumed when admitted, if not just cost
+	slot     any              //what's placed for the waiter, if it's identifiable
+	admitted chan struct{}
+}
+
+// waiters is a FIFO queue of requests blocked in Wait, it's not safe for
+// concurrent use; it's expected to be protected by the limiter's lock
+type waiters struct {
+	list list.List
+}
+
+func (w *waiters) len() int {
+	return w.list.Len()
+}
+
+func (w *waiters) push(cost int64) *list.Element {
+	return w.list.PushBack(&waiter{
+		cost:     cost,
+		admitted: make(chan struct{}),
+	})
+}
+
+// admit admits waiters in FIFO order as long as fn returns true for the
+// waiter at the front of the queue
+func (w *waiters) admit(fn func(cost int64) bool) {
+	w.admitWaiters(func(waiter *waiter) bool { return fn(waiter.cost) })
+}
+
+// admitWaiters is admit for limiters that need to record what the waiter
+// consumed (e.g. so it can be refunded exactly)
+func (w *waiters) admitWaiters(fn func(waiter *waiter) bool) {
+	for element := w.list.Front(); element != nil; element = w.list.Front() {
+		waiter := element.Value.(*waiter)
+		if !fn(waiter) {
+			return
+		}
+		w.list.Remove(element)
+		close(waiter.admitted)
+	}
+}
+
+// remove removes the waiter from the queue, it returns false if the waiter
+// was already admitted
+func (w *waiters) remove(element *list.Element) bool {
+	select {
+	case <-element.Value.(*waiter).admitted:
+		return false
+	default:
+	}
+	w.list.Remove(element)
+	return true
+}
+
+// wait blocks until the waiter is admitted or ctx is done; if ctx is done
+// the waiter is removed from the queue, or if it was admitted in the
+// meantime, what it consumed is refunded
+func wait(ctx context.Context, locker sync.Locker, w *waiters, element *list.Element, refund func()) error {
+	select {
+	case <-element.Value.(*waiter).admitted:
+		return nil
+	case <-ctx.Done():
+		locker.Lock()
+		removed := w.remove(element)
+		locker.Unlock()
+		if !removed && refund != nil {
+			refund()
+		}
+		return ctx.Err()
+	}
+}
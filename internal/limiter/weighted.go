@@ -1,10 +1,7 @@
 package limiter
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"io"
 	"net/http"
 	"sync"
 	"sync/atomic"
@@ -12,46 +9,82 @@ import (
 
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
-const weightedTokenBucketPrefix string = "[weighted_token_bucket] "
+const weightedTokenBucketComponent string = "weighted_token_bucket"
 
 type weightedTokenBucket struct {
 	sync.RWMutex
 	sync.WaitGroup
+	middlewareOptions
 	stopper           chan struct{}
 	buckets           map[string]*atomic.Int64
+	waiters           map[string]*waiters
 	maxTokens         int64
 	weightMultiplier  int64
 	replinishInterval time.Duration
+	carryDebt         bool
+	reservations      map[string]int64
+	owed              map[string]int64
+	grants            grants
+	replinished       atomic.Int64
 }
 
 func NewWeighted(parameters ...any) Limiter {
 	t := &weightedTokenBucket{
-		buckets: make(map[string]*atomic.Int64),
-		stopper: make(chan struct{}),
+		middlewareOptions: newMiddlewareOptions(),
+		grants:            make(grants),
+		buckets:           make(map[string]*atomic.Int64),
+		waiters:           make(map[string]*waiters),
+		reservations:      make(map[string]int64),
+		owed:              make(map[string]int64),
+		stopper:           make(chan struct{}),
 	}
 	for _, parameter := range parameters {
 		switch p := parameter.(type) {
+		case *logger.Logger:
+			t.logger = p
+		case *Metrics:
+			t.metrics = p
+		case Policy:
+			t.policy = p
+		case trace.TracerProvider:
+			t.tracer = p.Tracer(tracerName)
 		case *config.Configuration:
+			t.fromConfig(p)
 			t.maxTokens = p.Maxtokens
 			t.replinishInterval = p.TokenReplinish
 			t.weightMultiplier = p.WeightMultiplier
+			t.carryDebt = p.CarryDebt
 		}
 	}
+	t.logger = t.logger.Component(weightedTokenBucketComponent)
+	t.replinished.Store(time.Now().UnixNano())
 	t.launchReplinish()
 	return t
 }
 
 func (t *weightedTokenBucket) readBucket(id string) *atomic.Int64 {
 	t.RLock()
-	defer t.RUnlock()
 	i, ok := t.buckets[id]
-	if !ok {
-		i = new(atomic.Int64)
-		i.Add(t.maxTokens)
-		t.buckets[id] = i
+	t.RUnlock()
+	if ok {
+		return i
 	}
+	t.Lock()
+	defer t.Unlock()
+
+	//check again, the bucket may have been created since the read lock was
+	// released
+	if i, ok := t.buckets[id]; ok {
+		return i
+	}
+	i = new(atomic.Int64)
+	i.Add(t.maxTokens)
+	t.buckets[id] = i
 	return i
 }
 
@@ -59,11 +92,35 @@ func (t *weightedTokenBucket) replinish() {
 	t.Lock()
 	defer t.Unlock()
 
-	for _, i := range t.buckets {
-		t := t.maxTokens
-		i.Swap(t)
+	t.grants.expire()
+	for id, i := range t.buckets {
+		if owed := replenish(i, t.capacity(id), t.owed[id], t.carryDebt); owed > 0 {
+			t.owed[id] = owed
+		} else {
+			delete(t.owed, id)
+		}
+	}
+	for id, w := range t.waiters {
+		i := t.buckets[id]
+		w.admit(func(cost int64) bool { return take(i, cost) })
 	}
-	// fmt.Println(weightedTokenBucketPrefix + "tokens replenished")
+	t.replinished.Store(time.Now().UnixNano())
+	t.logger.Debug("tokens replenished")
+}
+
+// capacity returns the capacity of the bucket for the given id including any
+// extra capacity granted, the caller is expected to hold the lock
+func (t *weightedTokenBucket) capacity(id string) int64 {
+	return t.maxTokens + t.grants.extra(id)
+}
+
+// readCapacity returns the capacity of the bucket for the given id, it takes
+// the read lock
+func (t *weightedTokenBucket) readCapacity(id string) int64 {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.capacity(id)
 }
 
 func (t *weightedTokenBucket) launchReplinish() {
@@ -88,66 +145,185 @@ func (t *weightedTokenBucket) launchReplinish() {
 }
 
 func (t *weightedTokenBucket) Limit(ctx context.Context, id string, parameters ...any) bool {
-	var weight int64
+	var weight int64 = 1
 
 	for _, parameter := range parameters {
 		if i, ok := parameter.(int64); ok {
 			weight = i
 		}
 	}
+	cost := max(t.weightMultiplier*weight, 1) //a cost that isn't positive would add tokens
 	i := t.readBucket(id)
-	v := i.Load()
-	if v <= 0 {
-		fmt.Printf(weightedTokenBucketPrefix+"%s limited (%d)\n", id, v)
+	if !take(i, cost) {
+		t.logger.Decision("limited", "id", id, "tokens", i.Load(), "cost", cost)
 		return true
 	}
-	v = i.Add(-1 * t.weightMultiplier * weight)
-	fmt.Printf(weightedTokenBucketPrefix+"%s allowed (%d)\n", id, v)
+	findReceipt(parameters...).record(t, map[string]int64{id: cost})
+	t.logger.Decision("allowed", "id", id, "tokens", i.Load(), "cost", cost)
 	return false
 }
 
-func (t *weightedTokenBucket) Middleware(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//read the request from bytes
-		request := data.NewRequest()
-		bodyBytes, err := io.ReadAll(r.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			if _, err = w.Write([]byte(err.Error())); err != nil {
-				fmt.Printf(weightedTokenBucketPrefix+"error while writing bytes: %s\n", err.Error())
-			}
-			return
-		}
-		_ = r.Body.Close()
-		if err := request.UnmarshalBinary(bodyBytes); err != nil {
-			if _, err = w.Write([]byte(err.Error())); err != nil {
-				fmt.Printf(weightedTokenBucketPrefix+"error while writing bytes: %s\n", err.Error())
-			}
-			return
-		}
+func (t *weightedTokenBucket) Balance(id string) int64 {
+	return t.readBucket(id).Load()
+}
 
-		//execute the rate limiter
-		if t.Limit(r.Context(), request.ApplicationId, int64(request.Weight)) {
-			bytes := []byte("too many requests received")
-			w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
-			w.WriteHeader(http.StatusTooManyRequests)
-			if _, err := w.Write(bytes); err != nil {
-				fmt.Printf(weightedTokenBucketPrefix+"error while writing bytes: %s\n", err.Error())
-			}
-			return
+func (t *weightedTokenBucket) Charge(id string, cost int64) {
+	if cost < 0 {
+		refill(t.readBucket(id), -t.weightMultiplier*cost, t.readCapacity(id))
+		return
+	}
+	t.readBucket(id).Add(-t.weightMultiplier * cost)
+}
+
+// Refund returns the tokens taken for the request: what Limit recorded in the
+// receipt if there is one, otherwise the given weight times the multiplier
+func (t *weightedTokenBucket) Refund(id string, parameters ...any) {
+	var cost int64
+
+	for _, parameter := range parameters {
+		if i, ok := parameter.(int64); ok {
+			cost = t.weightMultiplier * max(i, 0) //negative weights would take tokens
 		}
+	}
+	if charges, ok := findReceipt(parameters...).take(t); ok {
+		cost = charges[id]
+	}
+	refill(t.readBucket(id), cost, t.readCapacity(id))
+}
 
-		//execute next endpoint
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		next(w, r)
+func (t *weightedTokenBucket) Wait(ctx context.Context, id string, cost int64) error {
+	cost = max(t.weightMultiplier*cost, 1) //a cost that isn't positive would add tokens
+	if cost > t.maxTokens {
+		return ErrCostExceedsCapacity
+	}
+	i := t.readBucket(id)
+	t.Lock()
+	w, ok := t.waiters[id]
+	if !ok {
+		w = &waiters{}
+		t.waiters[id] = w
+	}
+	if w.len() == 0 && take(i, cost) {
+		t.Unlock()
+		return nil
+	}
+	element := w.push(cost)
+	t.Unlock()
+	t.logger.Decision("waiting", "id", id, "cost", cost)
+	return wait(ctx, t, w, element, func() {
+		refill(i, cost, t.readCapacity(id))
 	})
 }
 
-func (t *weightedTokenBucket) Stop() {
+func (t *weightedTokenBucket) Reserve(ctx context.Context, id string, cost int64) *Reservation {
+	cost = max(t.weightMultiplier*cost, 1) //a cost that isn't positive would add tokens
+	if cost > t.maxTokens {
+		return &Reservation{}
+	}
+	i := t.readBucket(id)
+	t.Lock()
+	v := i.Add(-cost)
+	t.reservations[id] += cost
+	reservedAt := t.reservations[id]
+	owed := -v
+	if !t.carryDebt {
+		t.owed[id] += owe(cost, v)
+		owed = t.owed[id]
+	}
+	capacity := t.capacity(id)
+	t.Unlock()
+	delay := reservationDelay(owed, capacity, t.replinishInterval, time.Unix(0, t.replinished.Load()))
+	t.logger.Decision("reserved", "id", id, "cost", cost, "delay", delay)
+	return newReservation(delay, func() {
+		t.Lock()
+		defer t.Unlock()
+		n := unused(cost, reservedAt, t.reservations[id])
+		refill(i, n, t.capacity(id))
+		if owed := t.owed[id] - min(n, t.owed[id]); owed > 0 {
+			t.owed[id] = owed
+		} else {
+			delete(t.owed, id)
+		}
+	})
+}
+
+// Reset fills the bucket for the given id and removes any grant
+func (t *weightedTokenBucket) Reset(id string) {
+	i := t.readBucket(id)
 	t.Lock()
 	defer t.Unlock()
 
+	delete(t.grants, id)
+	delete(t.owed, id)
+	i.Store(t.capacity(id))
+	if w, ok := t.waiters[id]; ok {
+		w.admit(func(cost int64) bool { return take(i, cost) })
+	}
+	t.logger.Info("reset", "id", id)
+}
+
+// Grant increases the capacity of the bucket for the given id (and adds the
+// tokens to it) until the duration elapses
+func (t *weightedTokenBucket) Grant(id string, tokens int64, duration time.Duration) {
+	i := t.readBucket(id)
+	t.Lock()
+	defer t.Unlock()
+
+	t.grants[id] = grant{tokens: tokens, expires: time.Now().Add(duration)}
+	refill(i, tokens, t.capacity(id))
+	if w, ok := t.waiters[id]; ok {
+		w.admit(func(cost int64) bool { return take(i, cost) })
+	}
+	t.logger.Info("granted", "id", id, "tokens", tokens, "duration", duration)
+}
+
+func (t *weightedTokenBucket) Keys() []string {
+	t.RLock()
+	defer t.RUnlock()
+
+	keys := make([]string, 0, len(t.buckets))
+	for id := range t.buckets {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+func (t *weightedTokenBucket) KeyState(id string) *data.KeyState {
+	t.RLock()
+	defer t.RUnlock()
+
+	i, ok := t.buckets[id]
+	if !ok {
+		return nil
+	}
+	s := &data.KeyState{
+		Key:      id,
+		Tokens:   i.Load(),
+		LastSeen: t.seen.load(id),
+	}
+	if capacity := t.capacity(id); capacity > 0 {
+		s.Fill = float64(max(s.Tokens, 0)) / float64(capacity)
+	}
+	if w, ok := t.waiters[id]; ok {
+		s.QueueLength = w.len()
+	}
+	return s
+}
+
+func (t *weightedTokenBucket) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return middleware(t, LimiterTypeWeighted, t.middlewareOptions, next)
+}
+
+func (t *weightedTokenBucket) Check(ctx context.Context) error {
+	if err := checkStopper(t.stopper); err != nil {
+		return err
+	}
+	return checkStalled(&t.replinished, t.replinishInterval)
+}
+
+func (t *weightedTokenBucket) Stop() {
+	//the lock isn't held while waiting, the replenish goroutine may need it
 	close(t.stopper)
-	t.Wait()
-	fmt.Println(weightedTokenBucketPrefix + "stopped")
+	t.WaitGroup.Wait()
+	t.logger.Info("stopped")
 }
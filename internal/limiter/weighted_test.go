@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+// TestWeightedLimitCost verifies that the weighted token bucket only admits a
+// request if it has the tokens for its whole cost and that a refund returns
+// exactly what was taken
+func TestWeightedLimitCost(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	c.WeightMultiplier = 1
+	l := NewWeighted(c).(*weightedTokenBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	r := newReceipt()
+	if l.Limit(ctx, "id", int64(3), r) {
+		t.Fatal("expected a cost of 3 to be allowed")
+	}
+	if !l.Limit(ctx, "id", int64(2)) {
+		t.Fatal("expected a cost of 2 to be limited with 1 token left")
+	}
+	if v := l.Balance("id"); v != 1 {
+		t.Fatalf("expected a limited request not to take tokens, got %d tokens", v)
+	}
+	l.Refund("id", int64(3), r)
+	if v := l.Balance("id"); v != 4 {
+		t.Fatalf("expected the refund to return 3 tokens, got %d tokens", v)
+	}
+}
+
+// TestWeightedRefundGranted verifies that refunds and negative charges fill
+// the bucket up to its capacity including any grant rather than MAX_TOKENS
+func TestWeightedRefundGranted(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.TokenReplinish = time.Hour
+	c.WeightMultiplier = 1
+	l := NewWeighted(c).(*weightedTokenBucket)
+	defer l.Stop()
+	ctx := context.Background()
+
+	l.Grant("id", 4, time.Hour)
+	r := newReceipt()
+	if l.Limit(ctx, "id", int64(6), r) {
+		t.Fatal("expected a cost of 6 to be allowed with the grant")
+	}
+	l.Refund("id", int64(6), r)
+	if v := l.Balance("id"); v != 8 {
+		t.Fatalf("expected the refund to fill the granted capacity, got %d tokens", v)
+	}
+	l.Charge("id", 6)
+	l.Charge("id", -10)
+	if v := l.Balance("id"); v != 8 {
+		t.Fatalf("expected a negative charge to fill the granted capacity, got %d tokens", v)
+	}
+}
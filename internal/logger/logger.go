@@ -0,0 +1,108 @@
+package logger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+const (
+	FormatText string = "text"
+	FormatJSON string = "json"
+)
+
+// sampler allows one in every rate decisions to be logged, it's shared by
+// every logger derived from the same logger
+type sampler struct {
+	rate    int64
+	counter atomic.Int64
+}
+
+func (s *sampler) sample() bool {
+	if s == nil || s.rate <= 1 {
+		return true
+	}
+	return s.counter.Add(1)%s.rate == 1
+}
+
+// Logger is a leveled, structured logger (built on log/slog) that's provided
+// to components through their variadic parameters; per-request decisions
+// are logged with Decision so they're only logged at the debug level and can
+// be sampled
+type Logger struct {
+	*slog.Logger
+	sampler *sampler
+}
+
+var defaultLogger = &Logger{Logger: slog.New(slog.NewTextHandler(os.Stdout, nil))}
+
+// Default returns the logger used by components that weren't provided one,
+// it writes text at the info level to stdout without sampling
+func Default() *Logger {
+	return defaultLogger
+}
+
+func parseLevel(s string) slog.Level {
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// New creates a logger from the configuration (format, level and sample
+// rate), it writes to stdout unless an io.Writer is provided
+func New(parameters ...any) *Logger {
+	var w io.Writer = os.Stdout
+	var c *config.Configuration
+
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *config.Configuration:
+			c = p
+		case io.Writer:
+			w = p
+		}
+	}
+	if c == nil {
+		c = config.NewConfiguration()
+	}
+	options := &slog.HandlerOptions{Level: parseLevel(c.LogLevel)}
+	var handler slog.Handler = slog.NewTextHandler(w, options)
+	if c.LogFormat == FormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return &Logger{
+		Logger:  slog.New(handler),
+		sampler: &sampler{rate: int64(c.LogSampleRate)},
+	}
+}
+
+// Component returns a logger whose records are attributed to the given
+// component (e.g. "token_bucket"), if l is nil, the default logger is used
+func (l *Logger) Component(name string) *Logger {
+	if l == nil {
+		l = Default()
+	}
+	return &Logger{
+		Logger:  l.Logger.With("component", name),
+		sampler: l.sampler,
+	}
+}
+
+// Decision logs a per-request decision (e.g. a request being allowed or
+// limited) at the debug level so the hot path isn't logged by default, once
+// enabled, only one in every sample rate decisions is logged so it doesn't
+// flood the output
+func (l *Logger) Decision(msg string, args ...any) {
+	if !l.Enabled(context.Background(), slog.LevelDebug) || !l.sampler.sample() {
+		return
+	}
+	l.Debug(msg, args...)
+}
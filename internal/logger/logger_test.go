@@ -0,0 +1,89 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+)
+
+func newLogger(format, level string, sampleRate int) (*Logger, *bytes.Buffer) {
+	c := config.NewConfiguration()
+	c.LogFormat = format
+	c.LogLevel = level
+	c.LogSampleRate = sampleRate
+	buffer := &bytes.Buffer{}
+	return New(c, buffer), buffer
+}
+
+func lines(buffer *bytes.Buffer) []string {
+	return strings.Split(strings.TrimSpace(buffer.String()), "\n")
+}
+
+// TestLoggerJSON verifies that with the json format each record is a json
+// object that includes the component and the attributes
+func TestLoggerJSON(t *testing.T) {
+	l, buffer := newLogger(FormatJSON, "info", 1)
+
+	l.Component("token_bucket").Info("stopped", "id", "application_id")
+	record := make(map[string]any)
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatalf("expected a json record, got %q (%v)", buffer.String(), err)
+	}
+	for key, expected := range map[string]any{
+		"level":     "INFO",
+		"msg":       "stopped",
+		"component": "token_bucket",
+		"id":        "application_id",
+	} {
+		if record[key] != expected {
+			t.Fatalf("expected %s to be %v, got %v", key, expected, record[key])
+		}
+	}
+}
+
+// TestLoggerLevel verifies that records below the configured level aren't
+// written and that decisions are only written at the debug level
+func TestLoggerLevel(t *testing.T) {
+	l, buffer := newLogger(FormatText, "warn", 1)
+	l.Info("info")
+	l.Warn("warn")
+	if s := buffer.String(); strings.Contains(s, "msg=info") || !strings.Contains(s, "msg=warn") {
+		t.Fatalf("expected only the warning to be written, got %q", s)
+	}
+
+	l, buffer = newLogger(FormatText, "info", 1)
+	l.Decision("allowed")
+	if buffer.Len() != 0 {
+		t.Fatalf("expected decisions not to be written at the info level, got %q", buffer.String())
+	}
+	l, buffer = newLogger(FormatText, "debug", 1)
+	l.Decision("allowed")
+	if s := buffer.String(); !strings.Contains(s, "level=DEBUG") || !strings.Contains(s, "msg=allowed") {
+		t.Fatalf("expected the decision to be written at the debug level, got %q", s)
+	}
+}
+
+// TestLoggerSampler verifies that only one in every sample rate decisions is
+// written and that the sampler is shared by the loggers of each component
+func TestLoggerSampler(t *testing.T) {
+	l, buffer := newLogger(FormatText, "debug", 4)
+	a, b := l.Component("a"), l.Component("b")
+	for i := 0; i < 8; i++ {
+		a.Decision("allowed")
+		b.Decision("allowed")
+	}
+	if n := len(lines(buffer)); n != 4 {
+		t.Fatalf("expected 4 of 16 decisions to be written, got %d", n)
+	}
+	//other records aren't sampled
+	buffer.Reset()
+	for i := 0; i < 4; i++ {
+		a.Debug("debug")
+	}
+	if n := len(lines(buffer)); n != 4 {
+		t.Fatalf("expected every debug record to be written, got %d", n)
+	}
+}
@@ -0,0 +1,273 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+)
+
+const metricsComponent string = "metrics"
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType string = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	typeCounter   string = "counter"
+	typeGauge     string = "gauge"
+	typeHistogram string = "histogram"
+)
+
+// DefaultBuckets are the default upper bounds of a histogram
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// series is a single time series of a family, identified by its label
+// values; histograms use counts (one per bucket), sum and count
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// family is a metric with a name, help, type and label names, it contains
+// one series for every unique combination of label values
+type family struct {
+	sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+func (f *family) readSeries(labelValues []string) *series {
+	labelValues = append(labelValues, make([]string, max(len(f.labelNames)-len(labelValues), 0))...)
+	labelValues = labelValues[:len(f.labelNames)]
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// labels formats the label names and values, labels with an empty value
+// are omitted (they're equivalent to a missing label)
+func (f *family) labels(labelValues []string, extra ...string) string {
+	var pairs []string
+
+	for i, name := range f.labelNames {
+		if labelValues[i] != "" {
+			pairs = append(pairs, name+"="+quoteLabel(labelValues[i]))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes a label value as the Prometheus text format expects:
+// only backslash, double quote and line feed are escaped (strconv.Quote
+// would also escape non-ASCII and control characters, which Prometheus
+// doesn't unescape)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (f *family) write(buffer *bytes.Buffer) {
+	f.Lock()
+	defer f.Unlock()
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(buffer, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", f.name, f.kind)
+	for _, key := range keys {
+		s := f.series[key]
+		switch f.kind {
+		default:
+			fmt.Fprintf(buffer, "%s%s %s\n", f.name, f.labels(s.labelValues), formatFloat(s.value))
+		case typeHistogram:
+			var cumulative uint64
+			for i, bucket := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(buffer, "%s_bucket%s %d\n", f.name,
+					f.labels(s.labelValues, "le", formatFloat(bucket)), cumulative)
+			}
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(buffer, "%s_sum%s %s\n", f.name, f.labels(s.labelValues), formatFloat(s.sum))
+			fmt.Fprintf(buffer, "%s_count%s %d\n", f.name, f.labels(s.labelValues), s.count)
+		}
+	}
+}
+
+// Counter is a value that only increases
+type Counter struct{ *family }
+
+// Add adds the value to the series with the given label values (in the
+// same order as the label names)
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.readSeries(labelValues).value += value
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct{ *family }
+
+// Set sets the value of the series with the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.readSeries(labelValues).value = value
+}
+
+// Reset removes every series, it's used for gauges that are collected
+// when scraped so series that no longer exist aren't exposed
+func (g *Gauge) Reset() {
+	g.Lock()
+	defer g.Unlock()
+
+	g.series = make(map[string]*series)
+}
+
+// Histogram counts observations in configurable buckets
+type Histogram struct{ *family }
+
+// Observe adds a single observation to the series with the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	s := h.readSeries(labelValues)
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Registry contains metric families and writes them in the Prometheus text
+// exposition format, collectors are executed before every scrape
+type Registry struct {
+	sync.Mutex
+	logger     *logger.Logger
+	families   []*family
+	collectors []func()
+}
+
+func New(parameters ...any) *Registry {
+	r := &Registry{}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *logger.Logger:
+			r.logger = p
+		}
+	}
+	r.logger = r.logger.Component(metricsComponent)
+	return r
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labelNames []string) *family {
+	r.Lock()
+	defer r.Unlock()
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r.register(name, help, typeCounter, nil, labelNames)}
+}
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r.register(name, help, typeGauge, nil, labelNames)}
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds (in
+// increasing order), if no buckets are provided, DefaultBuckets is used
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Histogram{r.register(name, help, typeHistogram, buckets, labelNames)}
+}
+
+// OnCollect registers a function that's executed before every scrape (e.g.
+// to set gauges from the current state)
+func (r *Registry) OnCollect(collector func()) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.collectors = append(r.collectors, collector)
+}
+
+// WriteTo executes the collectors and writes every family to w
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	families := append([]*family{}, r.families...)
+	r.Unlock()
+	for _, collector := range collectors {
+		collector()
+	}
+	buffer := &bytes.Buffer{}
+	for _, f := range families {
+		f.write(buffer)
+	}
+	return buffer.WriteTo(w)
+}
+
+// Handler is a http handler that writes the metrics
+func (r *Registry) Handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if _, err := r.WriteTo(w); err != nil {
+		r.logger.Error("error while writing metrics", "error", err)
+	}
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestLabelEscaping verifies that label values are escaped as the Prometheus
+// text format expects: only backslash, double quote and line feed
+func TestLabelEscaping(t *testing.T) {
+	r := New()
+	c := r.NewCounter("requests_total", "Requests.", "key")
+	c.Add(1, "a\\b\"c\nd\té")
+	buffer := &bytes.Buffer{}
+	if _, err := r.WriteTo(buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := `requests_total{key="a\\b\"c\nd` + "\t" + `é"} 1`
+	if !strings.Contains(buffer.String(), expected) {
+		t.Fatalf("expected %q in:\n%s", expected, buffer.String())
+	}
+}
@@ -0,0 +1,190 @@
+package rls
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const rlsComponent string = "rls"
+
+type Server interface {
+	Start() error
+	Stop() error
+}
+
+// server is a standalone decision service that implements Envoy's rate
+// limit service (ratelimit.v3 ShouldRateLimit), every descriptor is a key
+// that's given to the limiter; the decision is OVER_LIMIT if any of the
+// descriptors is over the limit
+type server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	sync.WaitGroup
+	config struct {
+		port            string
+		drainTimeout    time.Duration
+		decisionTimeout time.Duration
+	}
+	logger      *logger.Logger
+	rateLimiter limiter.Limiter
+	tlsConfig   *tls.Config
+	listener    net.Listener
+	grpcServer  *grpc.Server
+}
+
+// New creates the rate limit service, if a net.Listener is provided (e.g.
+// an in-process listener) it's used instead of listening on the port
+func New(parameters ...any) Server {
+	s := &server{}
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *config.Configuration:
+			s.config.port = p.RlsPort
+			s.config.drainTimeout = p.DrainTimeout
+			s.config.decisionTimeout = p.DecisionTimeout
+		case limiter.Limiter:
+			s.rateLimiter = p
+		case *logger.Logger:
+			s.logger = p
+		case *tls.Config:
+			s.tlsConfig = p
+		case net.Listener:
+			s.listener = p
+		}
+	}
+	s.logger = s.logger.Component(rlsComponent)
+	return s
+}
+
+// descriptorKey returns the key for a descriptor: the domain followed by
+// its entries (e.g. "edge|remote_address=10.0.0.1,path=/wait")
+func descriptorKey(domain string, descriptor *ratelimitv3.RateLimitDescriptor) string {
+	entries := make([]string, 0, len(descriptor.GetEntries()))
+	for _, entry := range descriptor.GetEntries() {
+		entries = append(entries, entry.GetKey()+"="+entry.GetValue())
+	}
+	return domain + "|" + strings.Join(entries, ",")
+}
+
+// hitsAddend returns the cost of a descriptor, the descriptor's hits addend
+// takes precedence over the request's, zero is treated as one (for either)
+func hitsAddend(request *rlsv3.RateLimitRequest, descriptor *ratelimitv3.RateLimitDescriptor) int64 {
+	if h := descriptor.GetHitsAddend(); h != nil {
+		return max(int64(h.GetValue()), 1)
+	}
+	return max(int64(request.GetHitsAddend()), 1)
+}
+
+// ShouldRateLimit executes the limiter for every descriptor, a limiter that
+// holds capacity for as long as a request is in flight (e.g. concurrency) is
+// released immediately since the service only sees the decision
+func (s *server) ShouldRateLimit(ctx context.Context, request *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	header := make(http.Header)
+	remaining, retryAfter := int64(math.MaxInt64), time.Duration(0)
+	for _, descriptor := range request.GetDescriptors() {
+		id := descriptorKey(request.GetDomain(), descriptor)
+		limited := limiter.Decide(ctx, s.rateLimiter, id, s.config.decisionTimeout,
+			hitsAddend(request, descriptor), data.PriorityNormal)
+		status := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+		switch {
+		case limited:
+			status.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			if d, ok := limiter.RetryAfter(s.rateLimiter, id); ok {
+				status.DurationUntilReset = durationpb.New(d)
+				retryAfter = max(retryAfter, d)
+			}
+			s.logger.Decision("over limit", "id", id)
+		default:
+			if releaser, ok := s.rateLimiter.(limiter.Releaser); ok {
+				releaser.Release(id)
+			}
+			s.logger.Decision("ok", "id", id)
+		}
+		if inspector, ok := s.rateLimiter.(limiter.Inspector); ok {
+			if state := inspector.KeyState(id); state != nil {
+				status.LimitRemaining = uint32(min(max(state.Tokens, 0), math.MaxUint32))
+				remaining = min(remaining, max(state.Tokens, 0))
+			}
+		}
+		limiter.WriteHeaders(s.rateLimiter, id, header)
+		response.Statuses = append(response.Statuses, status)
+	}
+	if remaining != math.MaxInt64 {
+		header.Set(data.HeaderRateLimitRemaining, fmt.Sprint(remaining))
+	}
+	if retryAfter > 0 {
+		header.Set("Retry-After", fmt.Sprint(int64(math.Ceil(retryAfter.Seconds()))))
+	}
+	for key, values := range header {
+		for _, value := range values {
+			response.ResponseHeadersToAdd = append(response.ResponseHeadersToAdd,
+				&corev3.HeaderValue{Key: key, Value: value})
+		}
+	}
+	return response, nil
+}
+
+func (s *server) Start() error {
+	if s.listener == nil {
+		listener, err := net.Listen("tcp", ":"+s.config.port)
+		if err != nil {
+			return err
+		}
+		s.listener = listener
+	}
+	var options []grpc.ServerOption
+	if s.tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	s.grpcServer = grpc.NewServer(options...)
+	rlsv3.RegisterRateLimitServiceServer(s.grpcServer, s)
+	s.Add(1)
+	go func() {
+		defer s.Done()
+
+		s.logger.Info("rate limit service listening", "address", s.listener.Addr().String(), "tls", s.tlsConfig != nil)
+		if err := s.grpcServer.Serve(s.listener); err != nil {
+			s.logger.Error("rate limit service stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops accepting new streams and waits for pending decisions up to
+// the drain timeout, after which the remaining connections are closed
+func (s *server) Stop() error {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.grpcServer.GracefulStop()
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(s.config.drainTimeout):
+		s.logger.Warn("drain timeout elapsed, closing connections")
+		s.grpcServer.Stop()
+		<-stopped
+	}
+	s.Wait()
+	return nil
+}
@@ -0,0 +1,132 @@
+package rls
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// newClient starts the service on an in-process listener with a token
+// bucket of the given capacity (that isn't replenished during the test) and
+// returns a client connected to it
+func newClient(t *testing.T, capacity int64) rlsv3.RateLimitServiceClient {
+	t.Helper()
+
+	c := config.NewConfiguration()
+	c.Maxtokens = capacity
+	c.TokenReplinish = time.Hour
+	c.DrainTimeout = time.Second
+	rateLimiter := limiter.NewToken(c)
+	listener := bufconn.Listen(1 << 20)
+	s := New(c, rateLimiter, listener)
+	if err := s.Start(); err != nil {
+		rateLimiter.Stop()
+		t.Fatal(err)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = s.Stop()
+		rateLimiter.Stop()
+	})
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(value string, hitsAddend *wrapperspb.UInt64Value) *ratelimitv3.RateLimitDescriptor {
+	return &ratelimitv3.RateLimitDescriptor{
+		Entries:    []*ratelimitv3.RateLimitDescriptor_Entry{{Key: "remote_address", Value: value}},
+		HitsAddend: hitsAddend,
+	}
+}
+
+func shouldRateLimit(t *testing.T, client rlsv3.RateLimitServiceClient, hitsAddend uint32, descriptors ...*ratelimitv3.RateLimitDescriptor) *rlsv3.RateLimitResponse {
+	t.Helper()
+
+	response, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: descriptors,
+		HitsAddend:  hitsAddend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// TestShouldRateLimit verifies the decisions of the service: descriptors are
+// OK until the bucket is empty and OVER_LIMIT afterwards
+func TestShouldRateLimit(t *testing.T) {
+	client := newClient(t, 2)
+
+	for i, expected := range []rlsv3.RateLimitResponse_Code{
+		rlsv3.RateLimitResponse_OK,
+		rlsv3.RateLimitResponse_OK,
+		rlsv3.RateLimitResponse_OVER_LIMIT,
+	} {
+		response := shouldRateLimit(t, client, 0, descriptor("10.0.0.1", nil))
+		if code := response.GetOverallCode(); code != expected {
+			t.Fatalf("expected request %d to be %v, got %v", i, expected, code)
+		}
+		if code := response.GetStatuses()[0].GetCode(); code != expected {
+			t.Fatalf("expected the descriptor of request %d to be %v, got %v", i, expected, code)
+		}
+	}
+	//a descriptor with capacity left doesn't make up for one over the limit
+	response := shouldRateLimit(t, client, 0, descriptor("10.0.0.2", nil), descriptor("10.0.0.1", nil))
+	if code := response.GetOverallCode(); code != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("expected %v, got %v", rlsv3.RateLimitResponse_OVER_LIMIT, code)
+	}
+	if code := response.GetStatuses()[0].GetCode(); code != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("expected the first descriptor to be %v, got %v", rlsv3.RateLimitResponse_OK, code)
+	}
+}
+
+// TestShouldRateLimitHitsAddend verifies the cost of a descriptor: its own
+// hits addend takes precedence over the request's and zero is treated as one
+func TestShouldRateLimitHitsAddend(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		hitsAddend uint32
+		descriptor *wrapperspb.UInt64Value
+		remaining  uint32
+		code       rlsv3.RateLimitResponse_Code
+	}{
+		{name: "request", hitsAddend: 3, remaining: 1, code: rlsv3.RateLimitResponse_OK},
+		{name: "request_zero", hitsAddend: 0, remaining: 3, code: rlsv3.RateLimitResponse_OK},
+		{name: "request_over_capacity", hitsAddend: 5, remaining: 4, code: rlsv3.RateLimitResponse_OVER_LIMIT},
+		{name: "descriptor", hitsAddend: 5, descriptor: wrapperspb.UInt64(2), remaining: 2, code: rlsv3.RateLimitResponse_OK},
+		{name: "descriptor_zero", hitsAddend: 3, descriptor: wrapperspb.UInt64(0), remaining: 3, code: rlsv3.RateLimitResponse_OK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := newClient(t, 4)
+
+			response := shouldRateLimit(t, client, test.hitsAddend, descriptor("10.0.0.1", test.descriptor))
+			status := response.GetStatuses()[0]
+			if status.GetCode() != test.code {
+				t.Fatalf("expected %v, got %v", test.code, status.GetCode())
+			}
+			if status.GetLimitRemaining() != test.remaining {
+				t.Fatalf("expected %d remaining, got %d", test.remaining, status.GetLimitRemaining())
+			}
+		})
+	}
+}
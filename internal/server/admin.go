@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+)
+
+// authorized requires the admin token as a bearer token (compared in
+// constant time) before executing next
+func (s *server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) writeJson(w http.ResponseWriter, statusCode int, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
+	w.WriteHeader(statusCode)
+	if _, err = w.Write(bytes); err != nil {
+		s.logger.Error("error while writing bytes", "error", err)
+	}
+}
+
+// adminLimiter returns the limiter administered by a request: the limiter
+// of a route if it's selected (e.g. ?route=/ping), otherwise the global
+// limiter along with every route limiter (keys are listed from all of them,
+// the state of a key is the first one found and a key is reset or granted
+// in all of them)
+func (s *server) adminLimiter(w http.ResponseWriter, r *http.Request) (limiter.Limiter, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	route := r.URL.Query().Get(data.QueryAdminRoute)
+	switch {
+	case route == "" && len(s.routeLimiters) == 0:
+		return s.rateLimiter, true
+	case route == "":
+		return limiter.NewMulti(s.logger, s.limiters()), true
+	}
+	routeLimiter, ok := s.routeLimiters[route]
+	if !ok {
+		s.writeJson(w, http.StatusNotFound, fmt.Sprintf("no limiter for route %s", route))
+		return nil, false
+	}
+	return routeLimiter, true
+}
+
+func (s *server) endpointAdminKeys(w http.ResponseWriter, r *http.Request) {
+	rateLimiter, ok := s.adminLimiter(w, r)
+	if !ok {
+		return
+	}
+	inspector, ok := rateLimiter.(limiter.Inspector)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	keys := inspector.Keys()
+	if keys == nil {
+		keys = []string{}
+	}
+	s.writeJson(w, http.StatusOK, &data.Keys{Keys: keys})
+}
+
+func (s *server) endpointAdminKey(w http.ResponseWriter, r *http.Request) {
+	rateLimiter, ok := s.adminLimiter(w, r)
+	if !ok {
+		return
+	}
+	inspector, ok := rateLimiter.(limiter.Inspector)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	state := inspector.KeyState(r.PathValue("key"))
+	if state == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.writeJson(w, http.StatusOK, state)
+}
+
+func (s *server) endpointAdminKeyReset(w http.ResponseWriter, r *http.Request) {
+	rateLimiter, ok := s.adminLimiter(w, r)
+	if !ok {
+		return
+	}
+	administrator, ok := rateLimiter.(limiter.Administrator)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	key := r.PathValue("key")
+	administrator.Reset(key)
+	s.logger.Info("key reset", "key", key)
+	s.endpointAdminKey(w, r)
+}
+
+func (s *server) endpointAdminKeyGrant(w http.ResponseWriter, r *http.Request) {
+	rateLimiter, ok := s.adminLimiter(w, r)
+	if !ok {
+		return
+	}
+	administrator, ok := rateLimiter.(limiter.Administrator)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	grant := &data.Grant{}
+	if err := json.Unmarshal(bytes, grant); err != nil {
+		s.writeJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if grant.Tokens <= 0 || grant.Duration <= 0 {
+		s.writeJson(w, http.StatusBadRequest, "tokens and duration must be positive")
+		return
+	}
+	key := r.PathValue("key")
+	administrator.Grant(key, grant.Tokens, grant.Duration)
+	s.logger.Info("key granted", "key", key, "tokens", grant.Tokens, "duration", grant.Duration)
+	s.endpointAdminKey(w, r)
+}
+
+func (s *server) endpointAdminAccess(w http.ResponseWriter, r *http.Request) {
+	s.writeJson(w, http.StatusOK, s.access.List())
+}
+
+// readExpiry reads how long an allowlist or blocklist entry lasts, an empty
+// body means it never expires
+func (s *server) readExpiry(w http.ResponseWriter, r *http.Request) (*data.Expiry, bool) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.errorHandler(w, err)
+		return nil, false
+	}
+	expiry := &data.Expiry{}
+	if len(bytes) == 0 {
+		return expiry, true
+	}
+	if err := json.Unmarshal(bytes, expiry); err != nil {
+		s.writeJson(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if expiry.Duration < 0 {
+		s.writeJson(w, http.StatusBadRequest, "duration must not be negative")
+		return nil, false
+	}
+	return expiry, true
+}
+
+func (s *server) endpointAdminAllow(w http.ResponseWriter, r *http.Request) {
+	expiry, ok := s.readExpiry(w, r)
+	if !ok {
+		return
+	}
+	s.access.Allow(r.PathValue("key"), expiry.Duration)
+	s.endpointAdminAccess(w, r)
+}
+
+func (s *server) endpointAdminBlock(w http.ResponseWriter, r *http.Request) {
+	expiry, ok := s.readExpiry(w, r)
+	if !ok {
+		return
+	}
+	s.access.Block(r.PathValue("key"), expiry.Duration)
+	s.endpointAdminAccess(w, r)
+}
+
+func (s *server) endpointAdminRemove(w http.ResponseWriter, r *http.Request) {
+	s.access.Remove(r.PathValue("key"))
+	s.endpointAdminAccess(w, r)
+}
+
+// adminHandler returns the handler for the admin listener, every endpoint
+// requires the admin token
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(data.MethodAdminKeys+" "+data.RouteAdminKeys, s.authorized(s.endpointAdminKeys))
+	mux.HandleFunc(data.MethodAdminKey+" "+data.RouteAdminKey, s.authorized(s.endpointAdminKey))
+	mux.HandleFunc(data.MethodAdminKeyReset+" "+data.RouteAdminKeyReset, s.authorized(s.endpointAdminKeyReset))
+	mux.HandleFunc(data.MethodAdminKeyGrant+" "+data.RouteAdminKeyGrant, s.authorized(s.endpointAdminKeyGrant))
+	mux.HandleFunc(data.MethodAdminAccess+" "+data.RouteAdminAccess, s.authorized(s.endpointAdminAccess))
+	mux.HandleFunc(data.MethodAdminAllow+" "+data.RouteAdminAllow, s.authorized(s.endpointAdminAllow))
+	mux.HandleFunc(data.MethodAdminBlock+" "+data.RouteAdminBlock, s.authorized(s.endpointAdminBlock))
+	mux.HandleFunc(data.MethodAdminRemove+" "+data.RouteAdminRemove, s.authorized(s.endpointAdminRemove))
+	return mux
+}
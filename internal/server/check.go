@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+)
+
+// readCheck reads the key and cost of a check from the body (if there is
+// one) and the headers, the headers take precedence
+func readCheck(r *http.Request, bytes []byte) (*data.Check, error) {
+	var err error
+
+	check := &data.Check{Cost: 1}
+	if len(bytes) > 0 {
+		if err := json.Unmarshal(bytes, check); err != nil {
+			return nil, err
+		}
+	}
+	if s := r.Header.Get(data.HeaderRateLimitKey); s != "" {
+		check.Key = s
+	}
+	if s := r.Header.Get(data.HeaderRateLimitCost); s != "" {
+		if check.Cost, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return check, nil
+}
+
+// denyStatus returns the status code of a denied check, it's 429 unless the
+// gateway asks for 403 (nginx auth_request only passes through 401 and 403)
+func denyStatus(r *http.Request) int {
+	if r.Header.Get(data.HeaderRateLimitDenyStatus) == strconv.Itoa(http.StatusForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusTooManyRequests
+}
+
+// endpointCheck makes a decision for a key and cost without executing any
+// handler, so the server can be the limiter for other services (e.g. behind
+// a gateway); the allowlist and blocklist are evaluated first and the
+// response includes the rate limit headers
+func (s *server) endpointCheck(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	check, err := readCheck(r, bytes)
+	if err != nil {
+		s.writeJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if check.Key == "" || check.Cost <= 0 {
+		s.writeJson(w, http.StatusBadRequest, "key is required and cost must be positive")
+		return
+	}
+	decision := &data.Decision{Key: check.Key}
+	allowed, blocked, remaining := s.access.Lookup(check.Key)
+	switch {
+	case allowed:
+		decision.Allowed = true
+	case blocked:
+		if remaining > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(remaining.Seconds()))))
+		}
+	default:
+		limited := limiter.Decide(r.Context(), s.rateLimiter, check.Key, s.config.decisionTimeout,
+			check.Cost, data.PriorityNormal)
+		s.access.Observe(check.Key, limited)
+		decision.Allowed = !limited
+		switch {
+		case limited:
+			if retryAfter, ok := limiter.RetryAfter(s.rateLimiter, check.Key); ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(retryAfter.Seconds()))))
+			}
+		default:
+			if releaser, ok := s.rateLimiter.(limiter.Releaser); ok {
+				releaser.Release(check.Key)
+			}
+		}
+		if inspector, ok := s.rateLimiter.(limiter.Inspector); ok {
+			if state := inspector.KeyState(check.Key); state != nil {
+				tokens := max(state.Tokens, 0)
+				decision.Remaining = &tokens
+				w.Header().Set(data.HeaderRateLimitRemaining, fmt.Sprint(tokens))
+			}
+		}
+		limiter.WriteHeaders(s.rateLimiter, check.Key, w.Header())
+	}
+	s.logger.Decision("checked", "key", check.Key, "cost", check.Cost, "allowed", decision.Allowed)
+	statusCode := http.StatusOK
+	if !decision.Allowed {
+		statusCode = denyStatus(r)
+		if blocked {
+			statusCode = http.StatusForbidden
+		}
+	}
+	s.writeJson(w, statusCode, decision)
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+
+	"github.com/pkg/errors"
+)
+
+// routePolicyNone disables the limiter of a route (it's only limited by the
+// global limiter)
+const routePolicyNone string = "none"
+
+const (
+	pingCost          int64 = 1
+	computeCost       int64 = 3
+	computeIterations int   = 100000
+)
+
+// LimiterFactory creates the rate limiter for the policy of a route (e.g.
+// "token" or "leaky:shadow")
+type LimiterFactory func(route, policy string) (limiter.Limiter, error)
+
+// route is an endpoint of the route registry, if it has a policy, it's
+// limited by a limiter of its own after the global limiter; if it has a
+// cost, it replaces the weight declared by the client for both limiters
+type route struct {
+	method  string
+	path    string
+	policy  string
+	cost    func(bodyBytes []byte) int64
+	handler http.HandlerFunc
+}
+
+func fixedCost(cost int64) func([]byte) int64 {
+	return func([]byte) int64 { return cost }
+}
+
+// bytesCost returns the cost of a request from the size of its body in cost
+// bytes units, partial units are rounded up and the cost is at least one
+func (s *server) bytesCost(bodyBytes []byte) int64 {
+	if s.config.costBytesUnit <= 0 {
+		return 1
+	}
+	return max((int64(len(bodyBytes))+s.config.costBytesUnit-1)/s.config.costBytesUnit, 1)
+}
+
+// routes returns the route registry: /wait is only limited by the global
+// limiter, /ping is cheap, /compute is expensive and /upload is weighted by
+// the size of its body; the policies can be overridden by configuration
+func (s *server) routes() []route {
+	return []route{
+		{
+			method:  data.MethodWait,
+			path:    data.RouteWait,
+			handler: s.endpointWait,
+		},
+		{
+			method:  data.MethodPing,
+			path:    data.RoutePing,
+			policy:  string(limiter.LimiterTypeToken),
+			cost:    fixedCost(pingCost),
+			handler: s.endpointPing,
+		},
+		{
+			method:  data.MethodCompute,
+			path:    data.RouteCompute,
+			policy:  string(limiter.LimiterTypeWeighted),
+			cost:    fixedCost(computeCost),
+			handler: s.endpointCompute,
+		},
+		{
+			method:  data.MethodUpload,
+			path:    data.RouteUpload,
+			policy:  string(limiter.LimiterTypeWeighted),
+			cost:    s.bytesCost,
+			handler: s.endpointUpload,
+		},
+	}
+}
+
+// routeCapacity returns the most a request of the route can cost: the
+// capacity of the global limiter (MAX_TOKENS) or the route's limit if it's
+// lower
+func (s *server) routeCapacity(rt route) int64 {
+	capacity := s.config.maxTokens
+	if limit, ok := s.config.routeLimits[rt.path]; ok && (capacity <= 0 || limit < capacity) {
+		capacity = limit
+	}
+	return capacity
+}
+
+// costed provides the cost of the route to the limiters, the body is read
+// (and restored) since the cost can depend on it
+func (s *server) costed(rt route, next http.HandlerFunc) http.HandlerFunc {
+	if rt.cost == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		//the body is read before the limiter is executed, a body larger than
+		// the maximum is rejected here without being charged
+		bodyBytes, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			if maxBytesError := new(http.MaxBytesError); errors.As(err, &maxBytesError) {
+				s.writeText(w, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body larger than %d bytes", maxBytesError.Limit))
+				return
+			}
+			s.errorHandler(w, err)
+			return
+		}
+		//a cost the buckets can never hold would be limited forever, so it's
+		// rejected rather than told to retry
+		cost := rt.cost(bodyBytes)
+		if capacity := s.routeCapacity(rt); capacity > 0 && cost > capacity {
+			s.writeText(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request cost %d exceeds capacity %d", cost, capacity))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		next(w, r.WithContext(limiter.WithRequestCost(r.Context(), cost)))
+	}
+}
+
+// routeHandler returns the handler of a route, the global limiter is
+// executed first and then the route's limiter (if it has a policy); the
+// allowlist and blocklist are evaluated before either
+func (s *server) routeHandler(rt route) (http.HandlerFunc, error) {
+	policy := rt.policy
+	if p, ok := s.config.routePolicies[rt.path]; ok {
+		policy = p
+	}
+	rateLimiter := s.rateLimiter
+	switch {
+	case policy == "" || policy == routePolicyNone:
+	case s.limiterFactory == nil:
+		s.logger.Warn("no limiter factory, route only limited by the global limiter", "route", rt.path, "policy", policy)
+	default:
+		routeLimiter, err := s.limiterFactory(rt.path, policy)
+		if err != nil {
+			return nil, err
+		}
+		s.routeLimiters[rt.path] = routeLimiter
+		rateLimiter = limiter.NewMulti(s.logger, s.rateLimiter, routeLimiter)
+		s.logger.Info("configured route policy", "route", rt.path, "policy", policy)
+	}
+	return s.costed(rt, s.keyed(s.access.Middleware(rateLimiter, rt.handler))), nil
+}
+
+func (s *server) writeResponse(w http.ResponseWriter, response *data.Response) {
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
+	if _, err = w.Write(bytes); err != nil {
+		s.logger.Error("error while writing bytes", "error", err)
+	}
+}
+
+// endpointPing responds immediately, it's a cheap endpoint
+func (s *server) endpointPing(w http.ResponseWriter, r *http.Request) {
+	request := data.NewRequest()
+	if err := request.FromRequest(r); err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	s.writeResponse(w, &data.Response{
+		Id:            request.Id,
+		ApplicationId: request.ApplicationId,
+		Priority:      request.Priority,
+	})
+}
+
+// endpointCompute hashes the request repeatedly, it's an expensive
+// (cpu bound) endpoint
+func (s *server) endpointCompute(w http.ResponseWriter, r *http.Request) {
+	_, span := s.tracer.Start(r.Context(), "compute")
+	defer span.End()
+
+	request := data.NewRequest()
+	if err := request.FromRequest(r); err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	sum := sha256.Sum256([]byte(request.Id))
+	for i := 1; i < computeIterations; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	s.logger.Debug("compute completed", "request_id", request.Id, "sum", fmt.Sprintf("%x", sum[:4]))
+	s.writeResponse(w, &data.Response{
+		Id:            request.Id,
+		ApplicationId: request.ApplicationId,
+		Priority:      request.Priority,
+	})
+}
+
+// endpointUpload accepts a body of any size (up to the maximum body size)
+// and responds with the number of bytes received
+func (s *server) endpointUpload(w http.ResponseWriter, r *http.Request) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	request := data.NewRequest()
+	if err := request.UnmarshalBinary(bodyBytes); err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	s.writeResponse(w, &data.Response{
+		Id:            request.Id,
+		ApplicationId: request.ApplicationId,
+		Priority:      request.Priority,
+		Bytes:         int64(len(bodyBytes)),
+	})
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+)
+
+// startServer starts a server with a token bucket (that isn't replenished
+// during the test) as its global limiter and returns its address
+func startServer(t *testing.T, c *config.Configuration) string {
+	t.Helper()
+
+	c.Port = freePort(t)
+	c.TokenReplinish = time.Hour
+	c.DrainTimeout = time.Second
+	rateLimiter := limiter.NewToken(c)
+	s := New(c, rateLimiter)
+	if err := s.Start(); err != nil {
+		rateLimiter.Stop()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Stop()
+		rateLimiter.Stop()
+	})
+	return "http://localhost:" + c.Port
+}
+
+// TestCostedBodyTooLarge verifies that a body larger than the maximum that
+// doesn't declare its length is rejected with 413 when the route reads it to
+// compute its cost, without being charged by the limiter
+func TestCostedBodyTooLarge(t *testing.T) {
+	c := config.NewConfiguration()
+	c.MaxBodyBytes = 64
+	c.Maxtokens = 1
+	address := startServer(t, c)
+
+	body := `{"application_id":"application_id","data":"` + strings.Repeat("a", 128) + `"}`
+	//wrapping the reader hides its length, so the body is sent chunked
+	request, err := http.NewRequest(http.MethodPost, address+data.RouteUpload,
+		io.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d", http.StatusRequestEntityTooLarge, response.StatusCode)
+	}
+	response, err = http.Post(address+data.RouteUpload, "application/json",
+		strings.NewReader(`{"application_id":"application_id"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected the rejected request not to be charged, got %d", response.StatusCode)
+	}
+}
+
+// TestCostedCostExceedsCapacity verifies that a request whose cost is more
+// than the limiters can ever hold is rejected with 413 rather than limited
+func TestCostedCostExceedsCapacity(t *testing.T) {
+	c := config.NewConfiguration()
+	c.Maxtokens = 4
+	c.RouteLimits[data.RouteUpload] = 2
+	address := startServer(t, c)
+
+	for _, test := range []struct {
+		size       int
+		statusCode int
+	}{
+		{size: 1024, statusCode: http.StatusOK},
+		{size: 3 * 1024, statusCode: http.StatusRequestEntityTooLarge},
+		{size: 5 * 1024, statusCode: http.StatusRequestEntityTooLarge},
+	} {
+		body := `{"application_id":"application_id","data":"` + strings.Repeat("a", test.size-64) + `"}`
+		response, err := http.Post(address+data.RouteUpload, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != test.statusCode {
+			t.Fatalf("expected %d for %d bytes, got %d", test.statusCode, test.size, response.StatusCode)
+		}
+	}
+}
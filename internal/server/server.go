@@ -1,20 +1,50 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/certs"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
 	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/logger"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/metrics"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/tracing"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
-const serverLogPrefix string = "[server] "
+const serverComponent string = "server"
+
+// readyTimeout is how long the limiter's self-test has to complete before
+// the server is reported as not ready
+const readyTimeout time.Duration = time.Second
+
+// drainRetryAfter is the Retry-After of requests rejected while draining,
+// another instance is expected to be able to handle them
+const drainRetryAfter time.Duration = time.Second
+
+const (
+	keySourceApplicationId string = "application_id"
+	keySourceCertificate   string = "certificate"
+)
+
+const tracerName string = "github.com/antonio-alexander/go-blog-rate-limiting/internal/server"
 
 type server struct {
 	sync.WaitGroup
@@ -24,10 +54,35 @@ type server struct {
 		port           string
 		algorithm      string
 		tokenReplinish time.Duration
+		adminPort      string
+		adminToken     string
+		drainDelay     time.Duration
+		drainTimeout   time.Duration
+		timeouts       struct {
+			read, readHeader, write, idle time.Duration
+		}
+		maxBodyBytes    int64
+		keySource       string
+		costBytesUnit   int64
+		routePolicies   map[string]string
+		routeLimits     map[string]int64
+		maxTokens       int64
+		checkPort       string
+		decisionTimeout time.Duration
 	}
-	rateLimiter limiter.Limiter
-	httpServer  *http.Server
-	chError     chan error
+	logger         *logger.Logger
+	tracer         trace.Tracer
+	tlsConfig      *tls.Config
+	rateLimiter    limiter.Limiter
+	limiterFactory LimiterFactory
+	routeLimiters  map[string]limiter.Limiter
+	access         *limiter.Access
+	registry       *metrics.Registry
+	httpServer     *http.Server
+	adminServer    *http.Server
+	checkServer    *http.Server
+	chError        chan error
+	draining       atomic.Bool
 }
 
 func New(parameters ...any) Server {
@@ -39,34 +94,200 @@ func New(parameters ...any) Server {
 			s.config.port = p.Port
 			s.config.algorithm = p.Algorithm
 			s.config.tokenReplinish = p.TokenReplinish
+			s.config.adminPort = p.AdminPort
+			s.config.adminToken = p.AdminToken
+			s.config.drainDelay = p.DrainDelay
+			s.config.drainTimeout = p.DrainTimeout
+			s.config.timeouts.read = p.ReadTimeout
+			s.config.timeouts.readHeader = p.ReadHeaderTimeout
+			s.config.timeouts.write = p.WriteTimeout
+			s.config.timeouts.idle = p.IdleTimeout
+			s.config.maxBodyBytes = p.MaxBodyBytes
+			s.config.keySource = p.KeySource
+			s.config.costBytesUnit = p.CostBytesUnit
+			s.config.routePolicies = p.RoutePolicies
+			s.config.routeLimits = p.RouteLimits
+			s.config.maxTokens = p.Maxtokens
+			s.config.checkPort = p.CheckPort
+			s.config.decisionTimeout = p.DecisionTimeout
 		case limiter.Limiter:
 			s.rateLimiter = p
+		case *limiter.Access:
+			s.access = p
+		case *metrics.Registry:
+			s.registry = p
+		case *logger.Logger:
+			s.logger = p
+		case trace.TracerProvider:
+			s.tracer = p.Tracer(tracerName)
+		case *tls.Config:
+			s.tlsConfig = p
+		case LimiterFactory:
+			s.limiterFactory = p
 		}
 	}
+	if s.tracer == nil {
+		s.tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
+	if s.access == nil {
+		s.access = limiter.NewAccess(s.logger)
+	}
+	s.logger = s.logger.Component(serverComponent)
 	return s
 }
 
+func (s *server) writeText(w http.ResponseWriter, statusCode int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprint(len(text)))
+	w.WriteHeader(statusCode)
+	if _, err := w.Write([]byte(text)); err != nil {
+		s.logger.Error("error while writing bytes", "error", err)
+	}
+}
+
 func (s *server) errorHandler(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
+	statusCode := http.StatusInternalServerError
+	if maxBytesError := new(http.MaxBytesError); errors.As(err, &maxBytesError) {
+		statusCode = http.StatusRequestEntityTooLarge
+	}
+	w.WriteHeader(statusCode)
 	if _, err = w.Write([]byte(err.Error())); err != nil {
-		fmt.Printf(serverLogPrefix+"error while writing bytes: %s\n", err.Error())
+		s.logger.Error("error while writing bytes", "error", err)
+	}
+}
+
+// traced extracts the span context propagated by the client (W3C
+// traceparent) and starts a server span for every request
+func (s *server) traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bounded limits the size of request bodies before they're read (e.g. by
+// the limiter), bodies that are declared or turn out to be larger than the
+// maximum are rejected with 413
+func (s *server) bounded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.maxBodyBytes <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > s.config.maxBodyBytes {
+			s.writeText(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body larger than %d bytes", s.config.maxBodyBytes))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyed replaces the application id declared by the client with the
+// subject of its (verified) client certificate if the key source is the
+// certificate, so the rate limit key can't be spoofed; requests without a
+// client certificate are rejected with 401
+func (s *server) keyed(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.keySource != keySourceCertificate {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject := certs.Subject(r)
+		if subject == "" {
+			s.writeText(w, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		//the body is decoded generically so fields other than the request's
+		// (e.g. the payload of an upload) are kept
+		body := make(map[string]json.RawMessage)
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.errorHandler(w, err)
+			return
+		}
+		applicationId, err := json.Marshal(subject)
+		if err != nil {
+			s.errorHandler(w, err)
+			return
+		}
+		body["application_id"] = applicationId
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			s.errorHandler(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		r.ContentLength = int64(len(bodyBytes))
+		next(w, r)
 	}
 }
 
+// newHttpServer creates a http server with the configured timeouts, the
+// read header timeout keeps slow clients (e.g. slow loris) from holding
+// connections open without sending a request
+func (s *server) newHttpServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           s.bounded(handler),
+		ReadTimeout:       s.config.timeouts.read,
+		ReadHeaderTimeout: s.config.timeouts.readHeader,
+		WriteTimeout:      s.config.timeouts.write,
+		IdleTimeout:       s.config.timeouts.idle,
+		TLSConfig:         s.tlsConfig,
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// drained rejects new requests with 503 (and a Retry-After) once the server
+// is draining, health and readiness are still served so the draining state
+// can be observed
+func (s *server) drained(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() && r.URL.Path != data.RouteHealth && r.URL.Path != data.RouteReady {
+			w.Header().Set("Retry-After", fmt.Sprint(int64(drainRetryAfter.Seconds())))
+			w.Header().Set("Connection", "close")
+			s.writeText(w, http.StatusServiceUnavailable, "server is draining")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *server) endpointWait(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "wait")
+	defer span.End()
+
 	//get request
 	request := data.NewRequest()
 	if err := request.FromRequest(r); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		s.errorHandler(w, err)
 		return
 	}
+	span.SetAttributes(
+		attribute.String("request.id", request.Id),
+		attribute.String("request.application_id", request.ApplicationId),
+		attribute.Int64("request.wait_ms", request.Wait.Milliseconds()),
+	)
 
 	//execute business logic
 	select {
 	case <-time.After(request.Wait):
-		fmt.Printf(serverLogPrefix+"%s: wait of %v completed\n", request.Id, request.Wait)
-	case <-r.Context().Done():
-		fmt.Printf(serverLogPrefix+"%s: wait cancelled (context)\n", request.Id)
+		s.logger.Debug("wait completed", "request_id", request.Id, "wait", request.Wait)
+		limiter.Exclude(ctx, request.Wait)
+		limiter.SetCost(ctx, max(int64(request.Wait/time.Second), 1))
+	case <-ctx.Done():
+		s.logger.Debug("wait cancelled", "request_id", request.Id, "error", ctx.Err())
+		span.AddEvent("wait cancelled")
+		limiter.Refund(ctx)
 		return
 	}
 
@@ -76,6 +297,7 @@ func (s *server) endpointWait(w http.ResponseWriter, r *http.Request) {
 		ApplicationId: request.ApplicationId,
 		Wait:          request.Wait,
 		Weight:        request.Weight,
+		Priority:      request.Priority,
 	})
 	if err != nil {
 		s.errorHandler(w, err)
@@ -84,19 +306,69 @@ func (s *server) endpointWait(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
 	if _, err = w.Write(bytes); err != nil {
-		fmt.Printf(serverLogPrefix+"error while writing bytes: %s\n", err.Error())
+		s.logger.Error("error while writing bytes", "error", err)
 	}
 }
 
-func (s *server) launchServer() error {
+func (s *server) endpointQuota(w http.ResponseWriter, r *http.Request) {
+	quotaReader, ok := s.rateLimiter.(limiter.QuotaReader)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bytes, err := json.Marshal(quotaReader.Quota(r.PathValue("application_id")))
+	if err != nil {
+		s.errorHandler(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
+	if _, err = w.Write(bytes); err != nil {
+		s.logger.Error("error while writing bytes", "error", err)
+	}
+}
+
+// endpointHealth reports whether the server is alive (it's serving requests)
+func (s *server) endpointHealth(w http.ResponseWriter, r *http.Request) {
+	s.writeText(w, http.StatusOK, "ok")
+}
+
+// endpointReady reports whether the server should receive traffic, it isn't
+// ready while draining or if the limiter's self-test (e.g. its background
+// goroutines or shared store) fails
+func (s *server) endpointReady(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		s.writeText(w, http.StatusServiceUnavailable, "draining")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	for _, rateLimiter := range s.limiters() {
+		if checker, ok := rateLimiter.(limiter.Checker); ok {
+			if err := checker.Check(ctx); err != nil {
+				s.logger.Warn("not ready", "error", err)
+				s.writeText(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+		}
+	}
+	s.writeText(w, http.StatusOK, "ready")
+}
+
+func (s *server) launchServer(httpServer *http.Server) error {
 	started := make(chan struct{})
 	s.Add(1)
 	go func() {
 		defer s.Done()
 
 		close(started)
-		fmt.Printf(serverLogPrefix+"server listening on %s\n", s.httpServer.Addr)
-		if err := s.httpServer.ListenAndServe(); err != nil {
+		s.logger.Info("server listening", "address", httpServer.Addr, "tls", httpServer.TLSConfig != nil)
+		listenAndServe := httpServer.ListenAndServe
+		if httpServer.TLSConfig != nil {
+			//the certificates are in the tls config
+			listenAndServe = func() error { return httpServer.ListenAndServeTLS("", "") }
+		}
+		if err := listenAndServe(); err != nil {
 			if !errors.Is(err, http.ErrServerClosed) {
 				s.chError <- err
 			}
@@ -111,37 +383,167 @@ func (s *server) launchServer() error {
 	}
 }
 
+// limiters returns the global limiter followed by the route limiters, the
+// caller is expected to hold the (read) lock
+func (s *server) limiters() []limiter.Limiter {
+	limiters := []limiter.Limiter{s.rateLimiter}
+	for _, routeLimiter := range s.routeLimiters {
+		limiters = append(limiters, routeLimiter)
+	}
+	return limiters
+}
+
+// abort closes the listeners that were already started and stops the route
+// limiters, it's executed if Start fails so nothing is left serving; the
+// caller is expected to hold the lock
+func (s *server) abort(err error) error {
+	for _, httpServer := range []*http.Server{s.httpServer, s.checkServer, s.adminServer} {
+		if httpServer != nil {
+			_ = httpServer.Close()
+		}
+	}
+	s.Wait()
+	s.httpServer, s.checkServer, s.adminServer = nil, nil, nil
+	s.stopRouteLimiters()
+	return err
+}
+
+// stopRouteLimiters stops the limiters created for routes, the global
+// limiter is owned by whoever created it; the caller is expected to hold the
+// lock
+func (s *server) stopRouteLimiters() {
+	for _, routeLimiter := range s.routeLimiters {
+		routeLimiter.Stop()
+	}
+	s.routeLimiters = nil
+}
+
+// validate validates the configuration, it's executed before any listener
+// is started so a misconfigured server doesn't serve anything
+func (s *server) validate() error {
+	switch s.config.keySource {
+	default:
+		return errors.Errorf("unsupported key source: %s", s.config.keySource)
+	case keySourceApplicationId:
+	case keySourceCertificate:
+		if s.tlsConfig == nil || s.tlsConfig.ClientAuth < tls.VerifyClientCertIfGiven {
+			return errors.New("certificate key source requires client certificates to be verified")
+		}
+	}
+	if s.config.adminPort != "" && s.config.adminToken == "" {
+		return errors.New("admin token is required for the admin listener")
+	}
+	return nil
+}
+
 func (s *server) Start() error {
 	s.Lock()
 	defer s.Unlock()
 
+	if err := s.validate(); err != nil {
+		return err
+	}
+	s.routeLimiters = make(map[string]limiter.Limiter)
 	mux := http.NewServeMux()
-	mux.Handle(data.MethodWait+" "+data.RouteWait, s.rateLimiter.Middleware(s.endpointWait))
-	httpServer := &http.Server{Handler: mux}
-	httpServer.Addr = s.config.host
+	mux.HandleFunc(data.MethodHealth+" "+data.RouteHealth, s.endpointHealth)
+	mux.HandleFunc(data.MethodReady+" "+data.RouteReady, s.endpointReady)
+	for _, rt := range s.routes() {
+		handler, err := s.routeHandler(rt)
+		if err != nil {
+			s.stopRouteLimiters()
+			return err
+		}
+		mux.Handle(rt.method+" "+rt.path, handler)
+	}
+	if _, ok := s.rateLimiter.(limiter.QuotaReader); ok {
+		mux.HandleFunc(data.MethodQuota+" "+data.RouteQuota, s.endpointQuota)
+	}
+	if s.registry != nil {
+		mux.HandleFunc(data.MethodMetrics+" "+data.RouteMetrics, s.registry.Handler)
+	}
+	address := s.config.host
 	if s.config.port != "" {
-		httpServer.Addr = ":" + s.config.port
+		address = ":" + s.config.port
 	}
-	s.chError = make(chan error, 1)
+	httpServer := s.newHttpServer(address, s.traced(s.drained(mux)))
+	s.chError = make(chan error, 3)
 	s.httpServer = httpServer
-	return s.launchServer()
+	if err := s.launchServer(httpServer); err != nil {
+		return s.abort(err)
+	}
+	if s.config.checkPort != "" {
+		//the decision service is on a listener of its own so it's only
+		// reachable by the gateway, not by the clients it limits
+		checkMux := http.NewServeMux()
+		checkMux.HandleFunc(data.MethodCheck+" "+data.RouteCheck, s.endpointCheck)
+		s.checkServer = s.newHttpServer(":"+s.config.checkPort, s.traced(s.drained(checkMux)))
+		if err := s.launchServer(s.checkServer); err != nil {
+			return s.abort(err)
+		}
+	}
+	if s.config.adminPort == "" {
+		return nil
+	}
+	s.adminServer = s.newHttpServer(":"+s.config.adminPort, s.adminHandler())
+	if err := s.launchServer(s.adminServer); err != nil {
+		return s.abort(err)
+	}
+	return nil
 }
 
+// Stop drains and stops the listeners and then stops the route limiters;
+// the lock is only held while the server's state is read or changed, so
+// in-flight (e.g. admin) requests that need it can complete while draining.
+// Every listener is stopped even if one fails, the first error is returned
 func (s *server) Stop() error {
-	s.Lock()
-	defer s.Unlock()
+	var err error
 
+	s.RLock()
+	httpServers := []*http.Server{s.httpServer, s.checkServer, s.adminServer}
+	chError := s.chError
+	s.RUnlock()
 	defer func() {
-		close(s.chError)
+		if chError != nil {
+			close(chError)
+		}
 	}()
-	if err := s.httpServer.Close(); err != nil {
-		return err
+	//mark the server as not ready and give load balancers time to notice
+	// before the listeners are closed, new requests are rejected with 503
+	s.draining.Store(true)
+	s.logger.Info("draining", "delay", s.config.drainDelay, "timeout", s.config.drainTimeout)
+	time.Sleep(s.config.drainDelay)
+
+	//stop accepting connections and wait for in-flight requests (e.g. a
+	// multi-second wait) to complete, once the drain timeout elapses, any
+	// remaining connections are closed
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.drainTimeout)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if httpServer == nil {
+			continue
+		}
+		if e := httpServer.Shutdown(ctx); e != nil {
+			s.logger.Warn("drain timeout elapsed, closing connections", "address", httpServer.Addr, "error", e)
+			if e := httpServer.Close(); e != nil {
+				s.logger.Error("unable to close server", "address", httpServer.Addr, "error", e)
+				if err == nil {
+					err = e
+				}
+			}
+		}
 	}
 	s.Wait()
+	s.logger.Info("drained")
+	s.Lock()
+	s.stopRouteLimiters()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
 	select {
 	case <-time.After(time.Second): //wait one second for error
 		return nil
-	case err := <-s.chError:
+	case err := <-chError:
 		return err
 	}
 }
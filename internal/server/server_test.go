@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+)
+
+// TestStartFailureStopsEverything verifies that if a listener can't be
+// started, the listeners that were already started are closed and the route
+// limiters are stopped
+func TestStartFailureStopsEverything(t *testing.T) {
+	for _, listener := range []string{"check", "admin"} {
+		t.Run(listener, func(t *testing.T) {
+			//the listener's port is taken, so it fails after the main one
+			// started
+			taken, err := net.Listen("tcp", ":0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer taken.Close()
+			c := config.NewConfiguration()
+			c.Port = freePort(t)
+			c.CheckPort = freePort(t)
+			c.AdminPort = freePort(t)
+			c.AdminToken = "token"
+			switch listener {
+			case "check":
+				c.CheckPort = fmt.Sprint(taken.Addr().(*net.TCPAddr).Port)
+			case "admin":
+				c.AdminPort = fmt.Sprint(taken.Addr().(*net.TCPAddr).Port)
+			}
+			c.TokenReplinish = time.Hour
+			c.DrainTimeout = time.Second
+			rateLimiter := limiter.NewToken(c)
+			defer rateLimiter.Stop()
+			var routeLimiters []limiter.Limiter
+			factory := LimiterFactory(func(route, policy string) (limiter.Limiter, error) {
+				routeLimiter := limiter.NewToken(c)
+				routeLimiters = append(routeLimiters, routeLimiter)
+				return routeLimiter, nil
+			})
+			s := New(c, rateLimiter, factory)
+
+			if err := s.Start(); err == nil {
+				_ = s.Stop()
+				t.Fatal("expected the server not to start")
+			}
+			//the listeners started before the one that failed
+			started := []string{c.Port}
+			if listener == "admin" {
+				started = append(started, c.CheckPort)
+			}
+			for _, port := range started {
+				if response, err := http.Get("http://localhost:" + port + data.RouteHealth); err == nil {
+					_ = response.Body.Close()
+					t.Fatalf("expected the listener on %s to be closed", port)
+				}
+			}
+			if len(routeLimiters) == 0 {
+				t.Fatal("expected route limiters to be created")
+			}
+			for _, routeLimiter := range routeLimiters {
+				if err := routeLimiter.(limiter.Checker).Check(context.Background()); err == nil {
+					t.Fatal("expected the route limiters to be stopped")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/certs"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/data"
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/limiter"
+)
+
+// authority is a certificate authority created in memory, it signs the
+// server and client certificates of a test
+type authority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	dir         string
+	serial      int64
+}
+
+func newAuthority(t *testing.T) *authority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authority{certificate: certificate, key: key, dir: t.TempDir(), serial: 1}
+	a.write(t, "ca.pem", "CERTIFICATE", der)
+	return a
+}
+
+func (a *authority) write(t *testing.T, name, blockType string, bytes []byte) string {
+	t.Helper()
+
+	file := filepath.Join(a.dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue creates a certificate signed by the authority for the given common
+// name, it returns the certificate and key files
+func (a *authority) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(a.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.certificate, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.write(t, commonName+".pem", "CERTIFICATE", der),
+		a.write(t, commonName+"-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+// freePort returns a port that's free to listen on
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// startTLS starts a server with the given client auth and key source, the
+// server certificate is signed by the authority
+func startTLS(t *testing.T, a *authority, clientAuth, keySource string) string {
+	t.Helper()
+
+	c := config.NewConfiguration()
+	c.Port = freePort(t)
+	c.TLSCertFile, c.TLSKeyFile = a.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	c.TLSCAFile = filepath.Join(a.dir, "ca.pem")
+	c.TLSClientAuth = clientAuth
+	c.KeySource = keySource
+	c.DrainTimeout = time.Second
+	tlsConfig, err := certs.ServerConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rateLimiter := limiter.NewToken(c)
+	s := New(c, rateLimiter, tlsConfig)
+	if err := s.Start(); err != nil {
+		rateLimiter.Stop()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Stop()
+		rateLimiter.Stop()
+	})
+	return "https://localhost:" + c.Port
+}
+
+// newTLSClient creates a client that trusts the authority, it presents a
+// client certificate for the given common name if there is one
+func newTLSClient(t *testing.T, a *authority, commonName string) *http.Client {
+	t.Helper()
+
+	c := config.NewConfiguration()
+	c.TLSCAFile = filepath.Join(a.dir, "ca.pem")
+	if commonName != "" {
+		c.TLSCertFile, c.TLSKeyFile = a.issue(t, commonName, x509.ExtKeyUsageClientAuth)
+	}
+	tlsConfig, err := certs.ClientConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func ping(client *http.Client, address, applicationId string) (*http.Response, *data.Response, error) {
+	body, _ := (&data.Request{ApplicationId: applicationId, Weight: 1}).MarshalBinary()
+	response, err := client.Post(address+data.RoutePing, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response, nil, nil
+	}
+	r := &data.Response{}
+	if err := json.NewDecoder(response.Body).Decode(r); err != nil {
+		return nil, nil, err
+	}
+	return response, r, nil
+}
+
+// TestMutualTLSKeysByCertificate verifies that with the certificate key
+// source, requests are keyed by the subject of the client certificate
+// rather than the application id the client declared
+func TestMutualTLSKeysByCertificate(t *testing.T) {
+	a := newAuthority(t)
+	address := startTLS(t, a, certs.ClientAuthRequire, keySourceCertificate)
+
+	_, response, err := ping(newTLSClient(t, a, "customer-a"), address, "spoofed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response == nil || response.ApplicationId != "customer-a" {
+		t.Fatalf("expected the request to be keyed by the certificate, got %+v", response)
+	}
+}
+
+// TestMutualTLSRequireRejectsWithoutCertificate verifies that a client
+// without a certificate can't connect when client certificates are required
+func TestMutualTLSRequireRejectsWithoutCertificate(t *testing.T) {
+	a := newAuthority(t)
+	address := startTLS(t, a, certs.ClientAuthRequire, keySourceCertificate)
+
+	if _, _, err := ping(newTLSClient(t, a, ""), address, "spoofed"); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+}
+
+// TestMutualTLSVerifyIfGivenRequiresCertificateKey verifies that when client
+// certificates are optional, a request without one is rejected with 401 if
+// it's keyed by the certificate
+func TestMutualTLSVerifyIfGivenRequiresCertificateKey(t *testing.T) {
+	a := newAuthority(t)
+	address := startTLS(t, a, certs.ClientAuthVerifyIfGiven, keySourceCertificate)
+
+	response, _, err := ping(newTLSClient(t, a, ""), address, "spoofed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+}
+
+// TestTLSUntrustedClientCertificate verifies that a client certificate that
+// isn't signed by the configured authority is rejected
+func TestTLSUntrustedClientCertificate(t *testing.T) {
+	a := newAuthority(t)
+	address := startTLS(t, a, certs.ClientAuthRequire, keySourceApplicationId)
+	client := newTLSClient(t, a, "")
+	other := newAuthority(t)
+	certFile, keyFile := other.issue(t, "customer-b", x509.ExtKeyUsageClientAuth)
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{certificate}
+
+	if _, _, err := ping(client, address, "customer-b"); err == nil {
+		t.Fatal("expected an untrusted client certificate to be rejected")
+	}
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/antonio-alexander/go-blog-rate-limiting/internal/config"
+
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	ExporterNone   string = ""
+	ExporterStdout string = "stdout"
+	ExporterMemory string = "memory"
+)
+
+// Propagator propagates the span context through W3C traceparent (and
+// tracestate) headers
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Tracing is an optional trace provider, spans are exported in-process
+// (to stdout or an in-memory recorder) so no collector is needed; if no
+// exporter is configured, spans aren't recorded
+type Tracing struct {
+	trace.TracerProvider
+	provider *sdktrace.TracerProvider
+	recorder *tracetest.SpanRecorder
+}
+
+// New creates the tracing from the configuration, spans exported to stdout
+// are written to the provided io.Writer if there is one
+func New(parameters ...any) (*Tracing, error) {
+	var w io.Writer = os.Stdout
+	var exporter string
+
+	for _, parameter := range parameters {
+		switch p := parameter.(type) {
+		case *config.Configuration:
+			exporter = p.TracingExporter
+		case io.Writer:
+			w = p
+		}
+	}
+	t := &Tracing{}
+	switch exporter {
+	default:
+		t.TracerProvider = noop.NewTracerProvider()
+	case ExporterStdout:
+		e, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, err
+		}
+		t.provider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(e))
+		t.TracerProvider = t.provider
+	case ExporterMemory:
+		t.recorder = tracetest.NewSpanRecorder()
+		t.provider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(t.recorder))
+		t.TracerProvider = t.provider
+	}
+	return t, nil
+}
+
+// Ended returns the spans that have ended if the in-memory recorder is
+// used, otherwise it returns nil
+func (t *Tracing) Ended() []sdktrace.ReadOnlySpan {
+	if t.recorder == nil {
+		return nil
+	}
+	return t.recorder.Ended()
+}
+
+// Shutdown flushes and stops the exporter
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}